@@ -3,19 +3,30 @@ package main
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"strings"
 )
 
+// errBufferOverflow is returned by every write that doesn't fit the buffer
+var errBufferOverflow = errors.New("buffer overflow write")
+
 // BytePacketBuffer helper for reading/writing DNS packet bytes (512-byte buffer)
 type BytePacketBuffer struct {
 	buf []byte
 	pos int
+
+	// names maps lower-cased name suffixes already written to their offset,
+	// used for pointer compression on the write path (RFC 1035 4.1.4)
+	names    map[string]int
+	compress bool
 }
 
 func NewPacketBufferWithSize(size int) *BytePacketBuffer {
 	return &BytePacketBuffer{
-		buf: make([]byte, size),
-		pos: 0,
+		buf:      make([]byte, size),
+		pos:      0,
+		names:    make(map[string]int),
+		compress: true,
 	}
 }
 
@@ -28,6 +39,13 @@ func (b *BytePacketBuffer) Reset() {
 		b.buf[i] = 0
 	}
 	b.pos = 0
+	b.names = make(map[string]int)
+}
+
+// SetCompression enables or disables name compression for subsequent writes.
+// Canonical-form output (RFC 4034 6.2) must be written uncompressed.
+func (b *BytePacketBuffer) SetCompression(enabled bool) {
+	b.compress = enabled
 }
 
 func (b *BytePacketBuffer) Read() (byte, error) {
@@ -59,7 +77,7 @@ func (b *BytePacketBuffer) ReadUint32() (uint32, error) {
 
 func (b *BytePacketBuffer) Write(bytes []byte) error {
 	if b.pos+len(bytes) > len(b.buf) {
-		return errors.New("buffer overflow write")
+		return errBufferOverflow
 	}
 	copy(b.buf[b.pos:], bytes)
 	b.pos += len(bytes)
@@ -68,7 +86,7 @@ func (b *BytePacketBuffer) Write(bytes []byte) error {
 
 func (b *BytePacketBuffer) WriteUint16(v uint16) error {
 	if b.pos+2 > len(b.buf) {
-		return errors.New("buffer overflow write u16")
+		return fmt.Errorf("%w u16", errBufferOverflow)
 	}
 	binary.BigEndian.PutUint16(b.buf[b.pos:b.pos+2], v)
 	b.pos += 2
@@ -77,7 +95,7 @@ func (b *BytePacketBuffer) WriteUint16(v uint16) error {
 
 func (b *BytePacketBuffer) WriteUint32(v uint32) error {
 	if b.pos+4 > len(b.buf) {
-		return errors.New("buffer overflow write u32")
+		return fmt.Errorf("%w u32", errBufferOverflow)
 	}
 	binary.BigEndian.PutUint32(b.buf[b.pos:b.pos+4], v)
 	b.pos += 4
@@ -86,78 +104,119 @@ func (b *BytePacketBuffer) WriteUint32(v uint32) error {
 
 func (b *BytePacketBuffer) Current() int { return b.pos }
 func (b *BytePacketBuffer) Seek(pos int) error {
-	if pos < 0 || pos >= len(b.buf) {
+	if pos < 0 || pos > len(b.buf) {
 		return errors.New("invalid seek")
 	}
 	b.pos = pos
 	return nil
 }
+
+// truncate discards everything written from pos on, including any names
+// recorded there for compression
+func (b *BytePacketBuffer) truncate(pos int) {
+	b.pos = pos
+	for name, off := range b.names {
+		if off >= pos {
+			delete(b.names, name)
+		}
+	}
+}
+
 func (b *BytePacketBuffer) Bytes() []byte { return b.buf[:b.pos] }
-func (b *BytePacketBuffer) Len() int     { return b.pos }
+func (b *BytePacketBuffer) Len() int      { return b.pos }
+
+// maxNamePointers bounds the compression pointers followed for one name
+const maxNamePointers = 64
 
-// ReadQName reads a domain name, following pointers (RFC 1035) and returns full name
+// ReadQName reads a domain name, following pointers (RFC 1035 4.1.4) and
+// returns the full name. A pointer must lead to before the labels read so
+// far, so crafted pointer loops end in an error instead of running forever.
 func (b *BytePacketBuffer) ReadQName() (string, error) {
-	labels := []string{}
-	visited := 0
+	var labels []string
+	pos := b.pos
+	start := pos // where the current run of labels began
+	resume := -1 // just past the first pointer, where reading continues
+	length := 1  // wire length, including the root label
+	jumps := 0
 	for {
-		if visited > 256 {
-			return "", errors.New("too many label jumps")
+		if pos >= len(b.buf) {
+			return "", errors.New("end of buffer")
 		}
-		lenb, err := b.Read()
-		if err != nil {
-			return "", err
-		}
-		// pointer?
-		if lenb&0xC0 == 0xC0 {
-			offsetByte, err := b.Read()
-			if err != nil {
-				return "", err
+		lenb := int(b.buf[pos])
+		switch {
+		case lenb&0xC0 == 0xC0:
+			if pos+1 >= len(b.buf) {
+				return "", errors.New("end of buffer")
 			}
-			offset := int(((uint16(lenb) ^ 0xC0) << 8) | uint16(offsetByte))
-			cur := b.pos
-			if err := b.Seek(offset); err != nil {
-				return "", err
+			offset := (lenb&0x3F)<<8 | int(b.buf[pos+1])
+			if offset >= start {
+				return "", errors.New("name pointer doesn't point backwards")
 			}
-			part, err := b.ReadQName()
-			if err != nil {
-				return "", err
+			if jumps++; jumps > maxNamePointers {
+				return "", errors.New("too many name pointers")
 			}
-			labels = append(labels, part)
-			if err := b.Seek(cur); err != nil {
-				return "", err
+			if resume < 0 {
+				resume = pos + 2
 			}
-			break
-		}
-		if lenb == 0 {
-			break
-		}
-		if b.pos+int(lenb) > len(b.buf) {
-			return "", errors.New("label length overflow")
+			pos, start = offset, offset
+		case lenb&0xC0 != 0:
+			return "", fmt.Errorf("unsupported label type %#x", lenb&0xC0)
+		case lenb == 0:
+			if resume < 0 {
+				resume = pos + 1
+			}
+			b.pos = resume
+			return strings.Join(labels, "."), nil
+		default:
+			pos++
+			if pos+lenb > len(b.buf) {
+				return "", errors.New("label length overflow")
+			}
+			if length += lenb + 1; length > 255 {
+				return "", errors.New("name too long")
+			}
+			labels = append(labels, string(b.buf[pos:pos+lenb]))
+			pos += lenb
 		}
-		label := string(b.buf[b.pos : b.pos+int(lenb)])
-		labels = append(labels, label)
-		b.pos += int(lenb)
-		visited++
 	}
-	return strings.Join(labels, "."), nil
 }
 
-// WriteQName writes a domain name without pointer compression
+// WriteQName writes a domain name. When compression is enabled, the longest
+// suffix already present in the buffer is replaced by a pointer to it.
 func (b *BytePacketBuffer) WriteQName(name string) error {
+	name = strings.TrimSuffix(name, ".")
 	if name == "" {
 		return b.Write([]byte{0})
 	}
+	if len(name) > 253 {
+		return errors.New("name too long")
+	}
 	parts := strings.Split(name, ".")
-	for _, p := range parts {
+	for i, p := range parts {
+		if len(p) == 0 {
+			return errors.New("empty label")
+		}
 		if len(p) > 63 {
 			return errors.New("label too long")
 		}
+		suffix := ""
+		if b.compress {
+			suffix = strings.ToLower(strings.Join(parts[i:], "."))
+			if off, ok := b.names[suffix]; ok {
+				return b.WriteUint16(0xC000 | uint16(off))
+			}
+		}
+		start := b.pos
 		if err := b.Write([]byte{byte(len(p))}); err != nil {
 			return err
 		}
 		if err := b.Write([]byte(p)); err != nil {
 			return err
 		}
+		// pointers only have 14 bits of offset
+		if b.compress && start <= 0x3FFF {
+			b.names[suffix] = start
+		}
 	}
 	return b.Write([]byte{0})
 }
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+// queryWithName returns a 12-byte header announcing one question followed
+// by the given name bytes and type/class A IN
+func queryWithName(name ...byte) []byte {
+	data := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	data = append(data, name...)
+	return append(data, 0, 1, 0, 1)
+}
+
+func TestReadQNameRejectsPointerLoops(t *testing.T) {
+	tests := []struct {
+		desc string
+		data []byte
+	}{
+		// the name at offset 12 points at itself
+		{"self", queryWithName(0xC0, 12)},
+		// offset 12 points to 14, which points back to 12
+		{"mutual", queryWithName(0xC0, 14, 0xC0, 12)},
+		// a label followed by a pointer back to that label
+		{"label loop", queryWithName(1, 'a', 0xC0, 12)},
+		{"forward", queryWithName(0xC0, 20, 0, 0, 0, 0, 0, 0, 1, 'a', 0)},
+	}
+	for _, tt := range tests {
+		if _, err := FromBytes(tt.data); err == nil {
+			t.Errorf("%s: FromBytes accepted a looping name", tt.desc)
+		}
+	}
+}
+
+func TestReadQNameFollowsBackwardPointers(t *testing.T) {
+	// "example.com" at 12, then "www" + pointer to it at 25
+	data := queryWithName(7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0)
+	data = append(data, 3, 'w', 'w', 'w', 0xC0, 12, 0xFF)
+	buf := NewPacketBufferWithSize(len(data))
+	copy(buf.buf, data)
+	buf.pos = 29
+	name, err := buf.ReadQName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "www.example.com" {
+		t.Fatalf("got %q, want www.example.com", name)
+	}
+	if buf.pos != 35 {
+		t.Fatalf("reading continued at %d, want 35 just past the pointer", buf.pos)
+	}
+}
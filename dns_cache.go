@@ -1,83 +1,518 @@
 package main
 
 import (
+	"container/list"
+	"fmt"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
-	"fmt"
 )
 
+const (
+	// DefaultMaxNegativeTTL caps how long NXDOMAIN/NODATA answers are cached,
+	// at the upper end of the 1-3 hours suggested by RFC 2308 5
+	DefaultMaxNegativeTTL = 3 * time.Hour
+
+	DefaultCacheMaxEntries    = 100000
+	DefaultCacheSweepInterval = time.Minute
+
+	// DefaultStaleWindow is how long expired entries are kept for
+	// serve-stale (RFC 8767 suggests 1 to 3 days)
+	DefaultStaleWindow = 24 * time.Hour
+	// StaleTTL is the TTL given to stale answers (RFC 8767 4)
+	StaleTTL = 30
+
+	// an entry hit DefaultPrefetchHits times is refreshed once it enters
+	// the last DefaultPrefetchPercent of its TTL
+	DefaultPrefetchHits    = 3
+	DefaultPrefetchPercent = 10
+	// prefetchHitHalfLife is how fast hits stop counting towards
+	// DefaultPrefetchHits, so only recently popular entries are refreshed
+	prefetchHitHalfLife = time.Minute
+)
+
+// DnsCache is a TTL cache bounded by entry count and an approximate byte
+// budget. Keys are spread over independently locked shards so concurrent
+// queries rarely contend. The limits apply to the cache as a whole; once
+// they are exceeded, least recently used entries are evicted from the shard
+// that grew first, then from the others.
 type DnsCache struct {
-	mu sync.RWMutex
-	m  map[string]*CacheItem
+	shards []*cacheShard
+	count  atomic.Int64 // entries across all shards
+	size   atomic.Int64 // approximate bytes across all shards
+
+	maxEntries     int // 0 means unlimited
+	maxBytes       int // 0 means unlimited
+	maxNegativeTTL time.Duration
+	staleWindow    time.Duration // 0 disables serve-stale
+
+	prefetchHits    uint32 // 0 disables prefetching
+	prefetchPercent int
+	// prefetch refreshes a popular entry; it is called in its own goroutine
+	// and returns once the refresh has finished or failed
+	prefetch func(q *DnsQuestion)
+
+	sweeperMu   sync.Mutex
+	stopSweeper chan struct{}
 }
 
+type cacheShard struct {
+	c *DnsCache // for the shared configuration
+
+	mu    sync.Mutex
+	m     map[string]*list.Element // of *cacheEntry
+	lru   *list.List               // front is most recently used
+	bytes int
+
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+	staleHits   uint64
+	prefetches  uint64
+}
+
+type cacheEntry struct {
+	key      string
+	question DnsQuestion
+	item     *CacheItem
+	size     int
+	ttl      time.Duration // lifetime the entry was stored with
+
+	hits        uint32 // decayed by prefetchHitHalfLife, see recordHit
+	lastHit     time.Time
+	prefetching bool
+}
+
+// CacheStats is a snapshot of the cache counters
+type CacheStats struct {
+	Entries     int
+	Bytes       int
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	StaleHits   uint64
+	Prefetches  uint64
+}
+
+// CacheItem holds every RRset of an upstream response to one question,
+// so a hit can be answered exactly like the original response
 type CacheItem struct {
-	Record *DnsRecord
-	Expiry time.Time
+	Answers     []*DnsRecord
+	Authorities []*DnsRecord
+	Resources   []*DnsRecord
+	RCode       RCode
+	Expiry      time.Time
 }
 
 func NewDnsCache() *DnsCache {
-	return &DnsCache{
-		m: make(map[string]*CacheItem),
+	return NewDnsCacheWithShards(defaultShardCount())
+}
+
+// NewDnsCacheWithShards creates a cache split into n shards
+func NewDnsCacheWithShards(n int) *DnsCache {
+	if n < 1 {
+		n = 1
+	}
+	c := &DnsCache{
+		shards:         make([]*cacheShard, n),
+		maxEntries:     DefaultCacheMaxEntries,
+		maxNegativeTTL: DefaultMaxNegativeTTL,
+		staleWindow:    DefaultStaleWindow,
+
+		prefetchHits:    DefaultPrefetchHits,
+		prefetchPercent: DefaultPrefetchPercent,
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			c:   c,
+			m:   make(map[string]*list.Element),
+			lru: list.New(),
+		}
 	}
+	return c
 }
 
-func cacheKey(name string, qtype QType) string {
-	return fmt.Sprintf("%s|%d", name, uint16(qtype))
+// defaultShardCount scales the number of shards with the available CPUs,
+// leaving enough headroom that two busy goroutines rarely share one
+func defaultShardCount() int {
+	n := 1
+	for n < 4*runtime.GOMAXPROCS(0) && n < 256 {
+		n <<= 1
+	}
+	return n
+}
+
+// shard picks the shard owning key (FNV-1a)
+func (c *DnsCache) shard(key string) *cacheShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
 }
 
-func (c *DnsCache) Get(name string, qtype QType) (*DnsRecord, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	it, ok := c.m[cacheKey(name, qtype)]
+// cacheKey identifies a question; names compare case-insensitively
+func cacheKey(name string, qtype QType, qclass QClass) string {
+	return fmt.Sprintf("%s|%d|%d", normalizeName(name), uint16(qtype), uint16(qclass))
+}
+
+// Get returns a copy of the cached item whose records carry the TTL
+// remaining until expiry. Cached records are shared between goroutines and
+// never modified.
+func (c *DnsCache) Get(name string, qtype QType, qclass QClass) (*CacheItem, bool) {
+	key := cacheKey(name, qtype, qclass)
+	return c.shard(key).get(key)
+}
+
+func (c *cacheShard) get(key string) (*CacheItem, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.m[key]
 	if !ok {
+		c.misses++
 		return nil, false
 	}
-	if time.Now().After(it.Expiry) {
-		// expired
+	e := el.Value.(*cacheEntry)
+	now := time.Now()
+	if now.After(e.item.Expiry) {
+		// expired, but may still be kept around for serve-stale
+		if c.pastStaleWindow(e.item, now) {
+			c.removeElement(el)
+			c.expirations++
+		}
+		c.misses++
 		return nil, false
 	}
-	return it.Record, true
+	c.lru.MoveToFront(el)
+	c.hits++
+	e.recordHit(now)
+	remaining := e.item.Expiry.Sub(now)
+	c.maybePrefetch(e, remaining)
+	return e.item.withTTL(uint32(remaining / time.Second)), true
+}
+
+// maybePrefetch triggers a refresh of a popular entry that is about to
+// expire, so it gets replaced before clients see a miss. Caller must hold mu.
+func (c *cacheShard) maybePrefetch(e *cacheEntry, remaining time.Duration) {
+	cfg := c.c
+	if cfg.prefetch == nil || cfg.prefetchHits == 0 || e.prefetching || e.hits < cfg.prefetchHits {
+		return
+	}
+	if remaining*100 > e.ttl*time.Duration(cfg.prefetchPercent) {
+		return
+	}
+	e.prefetching = true
+	c.prefetches++
+	q := e.question
+	go func() {
+		cfg.prefetch(&q)
+		// a successful refresh replaced e; after a failed one it may be
+		// prefetched again
+		c.mu.Lock()
+		e.prefetching = false
+		c.mu.Unlock()
+	}()
+}
+
+// recordHit counts a hit, first halving the count once for every
+// prefetchHitHalfLife since the previous hit
+func (e *cacheEntry) recordHit(now time.Time) {
+	if halvings := now.Sub(e.lastHit) / prefetchHitHalfLife; halvings >= 32 {
+		e.hits = 0
+	} else if halvings > 0 {
+		e.hits >>= uint(halvings)
+	}
+	e.hits++
+	e.lastHit = now
+}
+
+// GetStale returns an expired entry that is still within the stale window,
+// with its records' TTL set to StaleTTL (RFC 8767)
+func (c *DnsCache) GetStale(name string, qtype QType, qclass QClass) (*CacheItem, bool) {
+	key := cacheKey(name, qtype, qclass)
+	return c.shard(key).getStale(key)
 }
 
-func (c *DnsCache) Put(name string, qtype QType, rec *DnsRecord) {
+func (c *cacheShard) getStale(key string) (*CacheItem, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	exp := time.Now().Add(time.Duration(rec.TTL) * time.Second)
-	c.m[cacheKey(name, qtype)] = &CacheItem{Record: rec, Expiry: exp}
+	el, ok := c.m[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.After(e.item.Expiry) || c.pastStaleWindow(e.item, now) {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.staleHits++
+	return e.item.withTTL(StaleTTL), true
+}
+
+// pastStaleWindow reports whether an item can no longer be served at all
+func (c *cacheShard) pastStaleWindow(it *CacheItem, now time.Time) bool {
+	return now.After(it.Expiry.Add(c.c.staleWindow))
 }
 
-func (c *DnsCache) PutMultiple(records []*DnsRecord) {
+// withTTL returns a copy of the item with every record's TTL set to ttl
+func (it *CacheItem) withTTL(ttl uint32) *CacheItem {
+	cp := *it
+	cp.Answers = recordsWithTTL(it.Answers, ttl)
+	cp.Authorities = recordsWithTTL(it.Authorities, ttl)
+	cp.Resources = recordsWithTTL(it.Resources, ttl)
+	return &cp
+}
+
+func recordsWithTTL(records []*DnsRecord, ttl uint32) []*DnsRecord {
+	out := make([]*DnsRecord, len(records))
+	for i, r := range records {
+		rc := *r
+		rc.TTL = ttl
+		out[i] = &rc
+	}
+	return out
+}
+
+// Put caches the sections of an upstream response to q. Positive entries
+// live as long as the shortest TTL among their records. NXDOMAIN and NODATA
+// answers are cached with just the SOA from the authority section, for the
+// negative TTL it implies (RFC 2308 3, 5); without an SOA they aren't cached.
+func (c *DnsCache) Put(q *DnsQuestion, resp *DnsPacket) {
+	it := &CacheItem{
+		Answers: resp.Answers,
+		RCode:   resp.Header.RESCODE,
+	}
+	var ttl uint32
+	switch {
+	case resp.Header.RESCODE == NOERROR && len(resp.Answers) > 0:
+		it.Authorities = resp.Authorities
+		it.Resources = resp.Resources
+		ttl, _ = minTTL(resp.Answers, resp.Authorities, resp.Resources)
+	case resp.Header.RESCODE == NXDOMAIN || resp.Header.RESCODE == NOERROR:
+		soa := findSOA(resp.Authorities)
+		if soa == nil {
+			return
+		}
+		it.Authorities = []*DnsRecord{soa}
+		ttl = c.negativeTTL(soa)
+		// a CNAME chain may lead to the nonexistent name
+		if answerTTL, ok := minTTL(resp.Answers); ok && answerTTL < ttl {
+			ttl = answerTTL
+		}
+	default:
+		return
+	}
+	if ttl == 0 {
+		return
+	}
+	lifetime := time.Duration(ttl) * time.Second
+	it.Expiry = time.Now().Add(lifetime)
+	c.store(q, it, lifetime)
+}
+
+// store inserts an item that expires at it.Expiry and was cached with the
+// given lifetime, replacing any entry for the same question
+func (c *DnsCache) store(q *DnsQuestion, it *CacheItem, lifetime time.Duration) {
+	key := cacheKey(q.Name, q.QType, q.QClass)
+	e := &cacheEntry{
+		key:      key,
+		question: *q,
+		item:     it,
+		size:     it.approxSize(key),
+		ttl:      lifetime,
+	}
+	c.shard(key).insert(e)
+}
+
+func (c *cacheShard) insert(e *cacheEntry) {
+	c.mu.Lock()
+	if el, ok := c.m[e.key]; ok {
+		c.removeElement(el)
+	}
+	c.m[e.key] = c.lru.PushFront(e)
+	c.bytes += e.size
+	c.c.count.Add(1)
+	c.c.size.Add(int64(e.size))
+	c.mu.Unlock()
+	c.c.evict(c)
+}
+
+// evict drops least recently used entries until the cache is within both
+// limits again: first from grown, keeping the entry just inserted there,
+// then from the other shards. Shards are locked one at a time.
+func (c *DnsCache) evict(grown *cacheShard) {
+	for c.overLimit() && grown.evictOldest(1) {
+	}
+	for _, sh := range c.shards {
+		for sh != grown && c.overLimit() && sh.evictOldest(0) {
+		}
+	}
+	// a single entry over the byte budget doesn't stay either
+	for c.overLimit() && grown.evictOldest(0) {
+	}
+}
+
+func (c *DnsCache) overLimit() bool {
+	return c.maxEntries > 0 && c.count.Load() > int64(c.maxEntries) ||
+		c.maxBytes > 0 && c.size.Load() > int64(c.maxBytes)
+}
+
+// evictOldest drops the least recently used entry unless the shard holds no
+// more than keep entries, and reports whether it did
+func (c *cacheShard) evictOldest(keep int) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.lru.Len() <= keep {
+		return false
+	}
+	c.removeElement(c.lru.Back())
+	c.evictions++
+	return true
+}
+
+// removeElement unlinks an entry. Caller must hold mu.
+func (c *cacheShard) removeElement(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.m, e.key)
+	c.bytes -= e.size
+	c.c.count.Add(-1)
+	c.c.size.Add(-int64(e.size))
+}
+
+// approxSize estimates the memory held by an item: a fixed overhead per
+// entry and record plus the length of names and RDATA
+func (it *CacheItem) approxSize(key string) int {
+	size := 128 + len(key)
+	for _, records := range [][]*DnsRecord{it.Answers, it.Authorities, it.Resources} {
+		for _, r := range records {
+			size += 64 + len(r.Name)
+			if r.RData != nil {
+				size += len(r.RData.String())
+			}
+		}
+	}
+	return size
+}
+
+// negativeTTL is the lesser of the SOA record's TTL and its MINIMUM field,
+// capped at maxNegativeTTL
+func (c *DnsCache) negativeTTL(soa *DnsRecord) uint32 {
+	ttl := soa.TTL
+	if rd, ok := soa.RData.(*RDataSOA); ok && rd.Minimum < ttl {
+		ttl = rd.Minimum
+	}
+	if limit := uint32(c.maxNegativeTTL / time.Second); ttl > limit {
+		ttl = limit
+	}
+	return ttl
+}
+
+func findSOA(records []*DnsRecord) *DnsRecord {
 	for _, r := range records {
-		key := cacheKey(r.Name, r.Type)
-		c.m[key] = &CacheItem{Record: r, Expiry: time.Now().Add(time.Duration(r.TTL) * time.Second)}
+		if r.Type == QTypeSOA {
+			return r
+		}
 	}
+	return nil
 }
 
-func (c *DnsCache) Stats() string {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	total := len(c.m)
-	active := 0
-	for k, v := range c.m {
-		if time.Now().Before(v.Expiry) && v.Record != nil {
-			active++
-		} else {
-			delete(c.m, k)
+// minTTL returns the smallest TTL across all records of the given sections
+func minTTL(sections ...[]*DnsRecord) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, records := range sections {
+		for _, r := range records {
+			if !found || r.TTL < ttl {
+				ttl = r.TTL
+				found = true
+			}
 		}
 	}
-	return fmt.Sprintf("Total: %d, Active: %d", total, active)
+	return ttl, found
+}
+
+// Counters returns a snapshot of the cache size and counters, summed over
+// all shards
+func (c *DnsCache) Counters() CacheStats {
+	var st CacheStats
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		st.Entries += sh.lru.Len()
+		st.Bytes += sh.bytes
+		st.Hits += sh.hits
+		st.Misses += sh.misses
+		st.Evictions += sh.evictions
+		st.Expirations += sh.expirations
+		st.StaleHits += sh.staleHits
+		st.Prefetches += sh.prefetches
+		sh.mu.Unlock()
+	}
+	return st
 }
 
+func (c *DnsCache) Stats() string {
+	st := c.Counters()
+	return fmt.Sprintf("Entries: %d, Bytes: ~%d, Hits: %d, Misses: %d, Stale: %d, Prefetches: %d, Evictions: %d, Expired: %d",
+		st.Entries, st.Bytes, st.Hits, st.Misses, st.StaleHits, st.Prefetches, st.Evictions, st.Expirations)
+}
+
+// Cleanup removes every entry that has expired and outlived the stale
+// window, one shard at a time
 func (c *DnsCache) Cleanup() {
+	for _, sh := range c.shards {
+		sh.cleanup()
+	}
+}
+
+func (c *cacheShard) cleanup() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	now := time.Now()
-	for k, v := range c.m {
-		if now.After(v.Expiry) {
-			delete(c.m, k)
+	for _, el := range c.m {
+		if c.pastStaleWindow(el.Value.(*cacheEntry).item, now) {
+			c.removeElement(el)
+			c.expirations++
+		}
+	}
+}
+
+// StartSweeper runs Cleanup every interval until Close is called. An
+// interval of zero or less disables the sweeper; expired entries are then
+// only dropped when looked up or evicted.
+func (c *DnsCache) StartSweeper(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	c.sweeperMu.Lock()
+	c.stopSweeper = stop
+	c.sweeperMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Cleanup()
+			case <-stop:
+				return
+			}
 		}
+	}()
+}
+
+// Close stops the background sweeper
+func (c *DnsCache) Close() {
+	c.sweeperMu.Lock()
+	defer c.sweeperMu.Unlock()
+	if c.stopSweeper != nil {
+		close(c.stopSweeper)
+		c.stopSweeper = nil
 	}
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// storeExpiring caches an answer for q that was stored with a 100s TTL and
+// has 5s left, inside the default prefetch window
+func storeExpiring(c *DnsCache, q *DnsQuestion) {
+	it := &CacheItem{RCode: NOERROR, Expiry: time.Now().Add(5 * time.Second)}
+	c.store(q, it, 100*time.Second)
+}
+
+func TestPrefetchRetriedAfterFailure(t *testing.T) {
+	c := NewDnsCacheWithShards(1)
+	calls := make(chan struct{}, 10)
+	c.prefetch = func(q *DnsQuestion) { calls <- struct{}{} } // fails: entry not replaced
+	q := &DnsQuestion{Name: "example.com", QType: QTypeA, QClass: QClassIN}
+	storeExpiring(c, q)
+
+	for range DefaultPrefetchHits {
+		c.Get(q.Name, q.QType, q.QClass)
+	}
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatal("popular entry was not prefetched")
+	}
+	// once the failed prefetch returns, the next hit tries again
+	deadline := time.After(time.Second)
+	for {
+		c.Get(q.Name, q.QType, q.QClass)
+		select {
+		case <-calls:
+			return
+		case <-deadline:
+			t.Fatal("entry was not prefetched again after a failed refresh")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestPrefetchHitsDecay(t *testing.T) {
+	e := &cacheEntry{}
+	now := time.Now()
+	for range 8 {
+		e.recordHit(now)
+	}
+	e.recordHit(now.Add(2 * prefetchHitHalfLife))
+	if e.hits != 3 {
+		t.Fatalf("got %d hits, want 8 halved twice plus one", e.hits)
+	}
+	e.recordHit(now.Add(time.Hour))
+	if e.hits != 1 {
+		t.Fatalf("got %d hits after an hour, want 1", e.hits)
+	}
+}
+
+func TestCacheLimitIsGlobal(t *testing.T) {
+	c := NewDnsCache()
+	c.maxEntries = 10
+	for i := range 100 {
+		storeExpiring(c, &DnsQuestion{Name: fmt.Sprintf("host%d.example.com", i), QType: QTypeA, QClass: QClassIN})
+	}
+	if n := c.Counters().Entries; n != 10 {
+		t.Fatalf("cache holds %d entries, want 10", n)
+	}
+	// the most recent entry survives
+	if _, ok := c.Get("host99.example.com", QTypeA, QClassIN); !ok {
+		t.Fatal("newest entry was evicted")
+	}
+}
+
+// benchResponse is an upstream answer for name with one A record
+func benchResponse(name string) *DnsPacket {
+	p := NewDnsPacket()
+	p.Header.Response = true
+	p.Answers = append(p.Answers, &DnsRecord{Name: name, Type: QTypeA, Class: QClassIN, TTL: 3600, RData: &RDataA{IP: []byte{192, 0, 2, 1}}})
+	return p
+}
+
+func benchQuestions(n int) []*DnsQuestion {
+	qs := make([]*DnsQuestion, n)
+	for i := range qs {
+		qs[i] = &DnsQuestion{Name: fmt.Sprintf("host%d.example.com", i), QType: QTypeA, QClass: QClassIN}
+	}
+	return qs
+}
+
+// benchShardCounts compares a single lock against the default sharding;
+// run with -cpu 1,4,16 to see throughput scale with GOMAXPROCS
+func benchShardCounts(b *testing.B, run func(b *testing.B, c *DnsCache)) {
+	for _, n := range []int{1, defaultShardCount()} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			c := NewDnsCacheWithShards(n)
+			c.prefetch = nil
+			run(b, c)
+		})
+	}
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	qs := benchQuestions(1024)
+	benchShardCounts(b, func(b *testing.B, c *DnsCache) {
+		for _, q := range qs {
+			c.Put(q, benchResponse(q.Name))
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.IntN(len(qs))
+			for pb.Next() {
+				q := qs[i%len(qs)]
+				c.Get(q.Name, q.QType, q.QClass)
+				i++
+			}
+		})
+	})
+}
+
+func BenchmarkCachePut(b *testing.B) {
+	qs := benchQuestions(1024)
+	resps := make([]*DnsPacket, len(qs))
+	for i, q := range qs {
+		resps[i] = benchResponse(q.Name)
+	}
+	benchShardCounts(b, func(b *testing.B, c *DnsCache) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.IntN(len(qs))
+			for pb.Next() {
+				c.Put(qs[i%len(qs)], resps[i%len(qs)])
+				i++
+			}
+		})
+	})
+}
+
+func negativeResponse(rcode RCode, soaTTL, minimum uint32) *DnsPacket {
+	p := NewDnsPacket()
+	p.Header.Response = true
+	p.Header.RESCODE = rcode
+	p.Authorities = append(p.Authorities, &DnsRecord{Name: "example.com", Type: QTypeSOA, Class: QClassIN, TTL: soaTTL,
+		RData: &RDataSOA{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 1, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: minimum}})
+	return p
+}
+
+func TestNegativeCaching(t *testing.T) {
+	tests := []struct {
+		desc    string
+		resp    *DnsPacket
+		wantTTL uint32 // 0 means not cached
+	}{
+		{"NXDOMAIN uses MINIMUM", negativeResponse(NXDOMAIN, 3600, 300), 300},
+		{"NODATA uses MINIMUM", negativeResponse(NOERROR, 3600, 120), 120},
+		{"SOA TTL below MINIMUM", negativeResponse(NXDOMAIN, 60, 300), 60},
+		{"capped by max-negative-ttl", negativeResponse(NXDOMAIN, 86400, 86400), uint32(DefaultMaxNegativeTTL / time.Second)},
+		{"no SOA", reply(aQuery("x"), NXDOMAIN), 0},
+		{"SERVFAIL", negativeResponse(SERVFAIL, 3600, 300), 0},
+	}
+	for _, tt := range tests {
+		c := NewDnsCache()
+		q := &DnsQuestion{Name: "missing.example.com", QType: QTypeA, QClass: QClassIN}
+		c.Put(q, tt.resp)
+		it, ok := c.Get(q.Name, q.QType, q.QClass)
+		if tt.wantTTL == 0 {
+			if ok {
+				t.Errorf("%s: cached, want not cached", tt.desc)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: not cached", tt.desc)
+			continue
+		}
+		if it.RCode != tt.resp.Header.RESCODE || len(it.Answers) != 0 || len(it.Authorities) != 1 {
+			t.Errorf("%s: got %s with %d answers and %d authorities, want %s with just the SOA",
+				tt.desc, it.RCode, len(it.Answers), len(it.Authorities), tt.resp.Header.RESCODE)
+		}
+		// one second may pass between Put and Get
+		if ttl := it.Authorities[0].TTL; ttl > tt.wantTTL || ttl+1 < tt.wantTTL {
+			t.Errorf("%s: SOA TTL %d, want %d", tt.desc, ttl, tt.wantTTL)
+		}
+	}
+}
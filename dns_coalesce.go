@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultMaxCoalescedWaiters bounds how many clients may wait on a single
+// in-flight upstream lookup
+const DefaultMaxCoalescedWaiters = 1024
+
+var errTooManyWaiters = errors.New("too many clients waiting for the same lookup")
+
+// Coalescer lets concurrent cache misses for the same question share one
+// upstream lookup: the first caller runs it, later callers wait for and
+// receive the same result.
+type Coalescer struct {
+	mu         sync.Mutex
+	calls      map[string]*inflightCall
+	maxWaiters int // 0 = unlimited
+
+	lookups   uint64 // lookups actually sent upstream
+	coalesced uint64 // callers that joined a lookup already in flight
+	rejected  uint64 // callers turned away because the waiter cap was hit
+}
+
+type inflightCall struct {
+	done    chan struct{}
+	resp    *DnsPacket
+	err     error
+	waiters int
+}
+
+// CoalescerStats is a snapshot of the coalescer counters
+type CoalescerStats struct {
+	InFlight  int
+	Lookups   uint64
+	Coalesced uint64
+	Rejected  uint64
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{
+		calls:      make(map[string]*inflightCall),
+		maxWaiters: DefaultMaxCoalescedWaiters,
+	}
+}
+
+// Do runs fn for key unless a call for the same key is already in flight,
+// in which case it waits for that call and returns its result. shared is
+// true for callers that joined another call. Once maxWaiters callers are
+// waiting, further ones get errTooManyWaiters.
+func (g *Coalescer) Do(key string, fn func() (*DnsPacket, error)) (resp *DnsPacket, shared bool, err error) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		if g.maxWaiters > 0 && call.waiters >= g.maxWaiters {
+			g.rejected++
+			g.mu.Unlock()
+			return nil, false, errTooManyWaiters
+		}
+		call.waiters++
+		g.coalesced++
+		g.mu.Unlock()
+		<-call.done
+		return call.resp, true, call.err
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.lookups++
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.resp, call.err = fn()
+	return call.resp, false, call.err
+}
+
+func (g *Coalescer) Counters() CoalescerStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return CoalescerStats{
+		InFlight:  len(g.calls),
+		Lookups:   g.lookups,
+		Coalesced: g.coalesced,
+		Rejected:  g.rejected,
+	}
+}
+
+func (g *Coalescer) Stats() string {
+	st := g.Counters()
+	return fmt.Sprintf("In flight: %d, Upstream lookups: %d, Coalesced: %d, Rejected: %d",
+		st.InFlight, st.Lookups, st.Coalesced, st.Rejected)
+}
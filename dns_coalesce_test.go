@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescerSharesInFlightLookups(t *testing.T) {
+	g := NewCoalescer()
+	g.maxWaiters = 2
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	want := reply(aQuery("example.com"), NOERROR)
+	lookup := func() (*DnsPacket, error) {
+		calls.Add(1)
+		close(started)
+		<-release
+		return want, nil
+	}
+
+	type result struct {
+		resp   *DnsPacket
+		shared bool
+		err    error
+	}
+	results := make(chan result, 5)
+	do := func() {
+		resp, shared, err := g.Do("example.com", lookup)
+		results <- result{resp, shared, err}
+	}
+	go do()
+	<-started
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do()
+		}()
+	}
+	// the two callers over the cap return at once, the others keep waiting
+	for i := range 2 {
+		select {
+		case r := <-results:
+			if r.err != errTooManyWaiters || r.shared {
+				t.Fatalf("caller over the cap got shared=%v err=%v, want errTooManyWaiters", r.shared, r.err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("only %d callers over the cap were turned away, want 2", i)
+		}
+	}
+
+	// a different question isn't held up by the one in flight
+	other, shared, err := g.Do("example.net", func() (*DnsPacket, error) { return reply(aQuery("example.net"), NOERROR), nil })
+	if err != nil || shared || other == want {
+		t.Fatalf("independent lookup: shared=%v err=%v", shared, err)
+	}
+
+	close(release)
+	wg.Wait()
+	var sharedCount int
+	for range 3 {
+		r := <-results
+		if r.err != nil || r.resp != want {
+			t.Fatalf("got %v, %v; want the in-flight result", r.resp, r.err)
+		}
+		if r.shared {
+			sharedCount++
+		}
+	}
+	if sharedCount != 2 {
+		t.Errorf("%d callers reported a shared result, want 2", sharedCount)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("lookup ran %d times, want 1", n)
+	}
+	st := g.Counters()
+	if st != (CoalescerStats{InFlight: 0, Lookups: 2, Coalesced: 2, Rejected: 2}) {
+		t.Errorf("got counters %+v", st)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDoHPath        = "/dns-query"
+	DefaultDoHIdleTimeout = 90 * time.Second
+	dnsMessageType        = "application/dns-message"
+)
+
+// dohClient sends queries to one DNS-over-HTTPS upstream (RFC 8484). The
+// HTTP transport keeps a pool of connections and multiplexes queries over
+// HTTP/2. The endpoint's hostname is resolved through the bootstrap
+// servers rather than the system resolver, which may well be us.
+type dohClient struct {
+	url       string
+	usePOST   bool
+	client    *http.Client
+	bootstrap *UpstreamPool
+
+	mu    sync.Mutex
+	addrs map[string]*bootstrapAddrs // hostname → addresses
+}
+
+type bootstrapAddrs struct {
+	ips    []string
+	expiry time.Time
+}
+
+func newDoHClient(url string, usePOST bool, config *tls.Config, bootstrap *UpstreamPool) *dohClient {
+	d := &dohClient{
+		url:       url,
+		usePOST:   usePOST,
+		bootstrap: bootstrap,
+		addrs:     make(map[string]*bootstrapAddrs),
+	}
+	d.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:         d.dial,
+			TLSClientConfig:     config,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     DefaultDoHIdleTimeout,
+		},
+	}
+	return d
+}
+
+// exchange sends query as an HTTP request and returns the answer with its
+// TTLs adjusted for the HTTP freshness information
+func (d *dohClient) exchange(query *DnsPacket, exactCase bool, timeout time.Duration) (*DnsPacket, error) {
+	// ID 0 keeps identical queries cacheable by HTTP caches (RFC 8484 4.1)
+	query.Header.ID = 0
+	raw, err := query.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var req *http.Request
+	if d.usePOST {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(raw))
+		if err == nil {
+			req.Header.Set("Content-Type", dnsMessageType)
+		}
+	} else {
+		sep := "?"
+		if strings.Contains(d.url, "?") {
+			sep = "&"
+		}
+		u := d.url + sep + "dns=" + base64.RawURLEncoding.EncodeToString(raw)
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dnsMessageType)
+
+	httpResp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH %s: HTTP status %s", d.url, httpResp.Status)
+	}
+	if ct := httpResp.Header.Get("Content-Type"); ct != dnsMessageType {
+		return nil, fmt.Errorf("DoH %s: unexpected content type %q", d.url, ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, 0x10000))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := parseUpstream(body)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(query, resp, exactCase); err != nil {
+		return nil, err
+	}
+	applyHTTPFreshness(resp, httpResp.Header)
+	return resp, nil
+}
+
+// applyHTTPFreshness brings the record TTLs in line with the HTTP caching
+// headers (RFC 8484 5.1): no TTL may outlive the response's max-age, and
+// time the response already spent in HTTP caches (Age) is deducted.
+// no-store or no-cache responses get TTL 0 so they aren't cached.
+func applyHTTPFreshness(resp *DnsPacket, h http.Header) {
+	maxAge := int64(-1)
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			maxAge = 0
+		case "max-age":
+			if v, err := strconv.ParseInt(value, 10, 64); err == nil && (maxAge < 0 || v < maxAge) {
+				maxAge = v
+			}
+		}
+	}
+	age, _ := strconv.ParseInt(h.Get("Age"), 10, 64)
+	if maxAge < 0 && age <= 0 {
+		return
+	}
+
+	for _, section := range [][]*DnsRecord{resp.Answers, resp.Authorities, resp.Resources} {
+		for _, r := range section {
+			ttl := int64(r.TTL)
+			if maxAge >= 0 {
+				ttl = min(ttl, maxAge)
+			}
+			r.TTL = uint32(max(ttl-age, 0))
+		}
+	}
+}
+
+// dial connects to the endpoint using addresses from the bootstrap servers
+func (d *dohClient) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.lookupHost(host)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrapping %s: %w", host, err)
+	}
+	var dialer net.Dialer
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// lookupHost returns the IPv4 addresses of host, asking the bootstrap
+// servers once the previous answer's TTL has run out
+func (d *dohClient) lookupHost(host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	d.mu.Lock()
+	cached, ok := d.addrs[host]
+	d.mu.Unlock()
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.ips, nil
+	}
+
+	query := NewDnsPacket()
+	query.Header.RecursionDesired = true
+	query.Questions = append(query.Questions, &DnsQuestion{Name: host, QType: QTypeA, QClass: QClassIN})
+	resp, err := d.bootstrap.Exchange(query, false)
+	if err != nil {
+		return nil, err
+	}
+	scrubResponse(resp, host, QTypeA, "")
+	var ips []string
+	ttl := uint32(0)
+	for _, r := range resp.Answers {
+		if a, ok := r.RData.(*RDataA); ok {
+			if len(ips) == 0 || r.TTL < ttl {
+				ttl = r.TTL
+			}
+			ips = append(ips, a.IP.String())
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses")
+	}
+	d.mu.Lock()
+	d.addrs[host] = &bootstrapAddrs{ips: ips, expiry: time.Now().Add(time.Duration(ttl) * time.Second)}
+	d.mu.Unlock()
+	return ips, nil
+}
+
+// close drops idle pooled connections
+func (d *dohClient) close() {
+	d.client.CloseIdleConnections()
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultDoHListenPort = 443
+	DefaultDoHServerIdle = 30 * time.Second
+	dnsJSONType          = "application/dns-json"
+
+	// AD and CD live in the low bits of DnsHeader.Z
+	zFlagAD = 0x2
+	zFlagCD = 0x1
+)
+
+// startDoHServer serves DNS-over-HTTPS (RFC 8484) on /dns-query and the
+// JSON API on /resolve. With dohPlain it speaks plain HTTP, for use behind
+// a reverse proxy that terminates TLS.
+func (s *DnsServer) startDoHServer() error {
+	srv := &http.Server{
+		Handler:           s.dohHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       s.dohIdleTimeout,
+	}
+
+	addr := fmt.Sprintf("0.0.0.0:%d", s.dohPort)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to bind DoH port %d: %w", s.dohPort, err)
+	}
+	serve := func() error { return srv.Serve(ln) }
+	if !s.dohPlain {
+		certs, err := newCertReloader(s.tlsCertFile, s.tlsKeyFile)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+		serve = func() error { return srv.ServeTLS(ln, "", "") }
+	}
+	log.Printf("🌐 DNS-over-HTTPS Server started on %s (plain HTTP: %v)", addr, s.dohPlain)
+
+	go func() {
+		if err := serve(); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("❌ DoH server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *DnsServer) dohHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", s.handleDoH)
+	mux.HandleFunc("/resolve", s.handleDNSJSON)
+	return mux
+}
+
+// handleDoH answers application/dns-message queries sent as POST bodies or
+// in the base64url "dns" parameter of a GET. GETs carrying a "name"
+// parameter or asking for application/dns-json get the JSON API instead.
+func (s *DnsServer) handleDoH(w http.ResponseWriter, r *http.Request) {
+	var msg []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Has("name") || strings.Contains(r.Header.Get("Accept"), dnsJSONType) {
+			s.handleDNSJSON(w, r)
+			return
+		}
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		msg, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dnsMessageType {
+			http.Error(w, "unsupported content type "+ct, http.StatusUnsupportedMediaType)
+			return
+		}
+		msg, err = io.ReadAll(io.LimitReader(r.Body, 0x10000))
+		if err == nil && len(msg) > 0xFFFF {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	packet, err := FromBytes(msg)
+	if err != nil {
+		log.Printf("❌ DoH parse failed: %v", err)
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+	startTime := time.Now()
+	client := s.httpClientAddr(r)
+	response := s.buildResponse(packet, client)
+	responseBytes, err := response.ToBytesWithSize(0xFFFF)
+	if err != nil {
+		log.Printf("❌ DoH encode failed: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	setCacheControl(w, response)
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(responseBytes)))
+	w.Write(responseBytes)
+	log.Printf("📤 DoH Response sent to %s in %v (size: %d bytes)", client, time.Since(startTime), len(responseBytes))
+}
+
+type dnsJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dnsJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
+// dnsJSONResponse is the application/dns-json format popularised by the
+// Google and Cloudflare resolvers
+type dnsJSONResponse struct {
+	Status     RCode
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Question   []dnsJSONQuestion
+	Answer     []dnsJSONRecord `json:",omitempty"`
+	Authority  []dnsJSONRecord `json:",omitempty"`
+	Additional []dnsJSONRecord `json:",omitempty"`
+}
+
+// handleDNSJSON answers GET ?name=example.com&type=AAAA with JSON. type
+// may be a mnemonic or a number and defaults to A; do=1 includes DNSSEC
+// records and cd=1 sets the CD bit.
+func (s *DnsServer) handleDNSJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	name := strings.TrimSuffix(params.Get("name"), ".")
+	if params.Get("name") == "" {
+		http.Error(w, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+	qtype := QTypeA
+	if t := params.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = QType(n)
+		} else if qtype, err = ParseQType(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	packet := NewDnsPacket()
+	packet.Header.RecursionDesired = true
+	if flagParam(params.Get("cd")) {
+		packet.Header.Z |= zFlagCD
+	}
+	if flagParam(params.Get("do")) {
+		packet.Edns = &Edns{UDPSize: 0xFFFF, DO: true}
+	}
+	packet.Questions = append(packet.Questions, &DnsQuestion{Name: name, QType: qtype, QClass: QClassIN})
+
+	response := s.buildResponse(packet, s.httpClientAddr(r))
+	out := dnsJSONResponse{
+		Status:     response.Header.RESCODE,
+		TC:         response.Header.Truncated,
+		RD:         response.Header.RecursionDesired,
+		RA:         response.Header.RecursionAvailable,
+		AD:         response.Header.Z&zFlagAD != 0,
+		CD:         packet.Header.Z&zFlagCD != 0,
+		Question:   []dnsJSONQuestion{{Name: fqdn(name), Type: uint16(qtype)}},
+		Answer:     jsonRecords(response.Answers),
+		Authority:  jsonRecords(response.Authorities),
+		Additional: jsonRecords(response.Resources),
+	}
+	body, err := json.Marshal(out)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setCacheControl(w, response)
+	w.Header().Set("Content-Type", dnsJSONType)
+	w.Write(body)
+}
+
+func jsonRecords(records []*DnsRecord) []dnsJSONRecord {
+	out := make([]dnsJSONRecord, 0, len(records))
+	for _, r := range records {
+		out = append(out, dnsJSONRecord{Name: fqdn(r.Name), Type: uint16(r.Type), TTL: r.TTL, Data: r.RData.String()})
+	}
+	return out
+}
+
+func flagParam(v string) bool {
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+// setCacheControl lets HTTP caches keep the response for as long as its
+// shortest-lived record (RFC 8484 5.1), counting an SOA by its negative
+// caching TTL (RFC 2308 5). SERVFAIL is never cached.
+func setCacheControl(w http.ResponseWriter, resp *DnsPacket) {
+	if resp.Header.RESCODE == SERVFAIL {
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+	ttl, found := uint32(0), false
+	for _, section := range [][]*DnsRecord{resp.Answers, resp.Authorities, resp.Resources} {
+		for _, r := range section {
+			rttl := r.TTL
+			if soa, ok := r.RData.(*RDataSOA); ok {
+				rttl = min(rttl, soa.Minimum)
+			}
+			if !found || rttl < ttl {
+				ttl, found = rttl, true
+			}
+		}
+	}
+	if found {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+}
+
+// httpClientAddr identifies the client for logging. Behind a reverse proxy
+// (plain HTTP mode) that is the first X-Forwarded-For entry.
+func (s *DnsServer) httpClientAddr(r *http.Request) string {
+	if s.dohPlain {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			client, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(client)
+		}
+	}
+	return r.RemoteAddr
+}
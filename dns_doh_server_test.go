@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// startTestDoHServer serves the DoH endpoints over plain HTTP, answering
+// www.example.com, NXDOMAIN for missing.example.com and SERVFAIL otherwise
+func startTestDoHServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	s, _ := newTestServer(t, func(q *DnsPacket) *DnsPacket {
+		switch q.Questions[0].Name {
+		case "www.example.com":
+			return reply(q, NOERROR, mustA(t, "www.example.com", "192.0.2.1"))
+		case "missing.example.com":
+			resp := negativeResponse(NXDOMAIN, 3600, 60)
+			resp.Header.ID = q.Header.ID
+			resp.Questions = q.Questions
+			return resp
+		}
+		return reply(q, SERVFAIL)
+	})
+	s.staleAnswerTimeout = 0
+	srv := httptest.NewServer(s.dohHandler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func dohQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	q := aQuery(name)
+	q.Header.ID = 0
+	raw, err := q.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestDoHServerWireFormat(t *testing.T) {
+	srv := startTestDoHServer(t)
+	tests := []struct {
+		name, cacheControl string
+		rcode              RCode
+	}{
+		{"www.example.com", "max-age=300", NOERROR},
+		{"missing.example.com", "max-age=60", NXDOMAIN},
+		{"broken.example.com", "no-store", SERVFAIL},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			raw := dohQuery(t, tt.name)
+			var resp *http.Response
+			var err error
+			if method == http.MethodGet {
+				resp, err = http.Get(srv.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(raw))
+			} else {
+				resp, err = http.Post(srv.URL+"/dns-query", dnsMessageType, bytes.NewReader(raw))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != dnsMessageType {
+				t.Fatalf("%s %s: got %s with %q", method, tt.name, resp.Status, resp.Header.Get("Content-Type"))
+			}
+			// the second request is served from the cache, maybe a second later
+			if cc := resp.Header.Get("Cache-Control"); cc != tt.cacheControl && cc != oneSecondLess(tt.cacheControl) {
+				t.Errorf("%s %s: Cache-Control %q, want %q", method, tt.name, cc, tt.cacheControl)
+			}
+			p, err := FromBytes(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Header.RESCODE != tt.rcode {
+				t.Errorf("%s %s: got %s, want %s", method, tt.name, p.Header.RESCODE, tt.rcode)
+			}
+		}
+	}
+}
+
+func oneSecondLess(cacheControl string) string {
+	var age int
+	if _, err := fmt.Sscanf(cacheControl, "max-age=%d", &age); err != nil {
+		return cacheControl
+	}
+	return fmt.Sprintf("max-age=%d", age-1)
+}
+
+func TestDoHServerJSON(t *testing.T) {
+	srv := startTestDoHServer(t)
+	resp, err := http.Get(srv.URL + "/resolve?name=www.example.com&type=A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != dnsJSONType {
+		t.Fatalf("Content-Type %q, want %q", ct, dnsJSONType)
+	}
+	var out dnsJSONResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Status != NOERROR || len(out.Answer) != 1 || out.Answer[0].Data != "192.0.2.1" || out.Answer[0].Name != "www.example.com." {
+		t.Fatalf("got %+v", out)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "max-age=300" {
+		t.Errorf("Cache-Control %q, want max-age=300", cc)
+	}
+}
+
+func TestDoHServerRejectsBadRequests(t *testing.T) {
+	srv := startTestDoHServer(t)
+	tests := []struct {
+		desc, method, path, contentType string
+		body                            []byte
+		want                            int
+	}{
+		{"missing dns parameter", http.MethodGet, "/dns-query", "", nil, http.StatusBadRequest},
+		{"bad base64", http.MethodGet, "/dns-query?dns=!!!", "", nil, http.StatusBadRequest},
+		{"malformed message", http.MethodPost, "/dns-query", dnsMessageType, []byte{1, 2, 3}, http.StatusBadRequest},
+		{"wrong content type", http.MethodPost, "/dns-query", "text/plain", dohQuery(t, "www.example.com"), http.StatusUnsupportedMediaType},
+		{"JSON without name", http.MethodGet, "/resolve", "", nil, http.StatusBadRequest},
+		{"JSON unknown type", http.MethodGet, "/resolve?name=example.com&type=BOGUS", "", nil, http.StatusBadRequest},
+		{"method", http.MethodPut, "/dns-query", dnsMessageType, nil, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, srv.URL+tt.path, bytes.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.desc, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestDoHClientAddrFromProxy(t *testing.T) {
+	s := NewDnsServer(0)
+	r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+	r.RemoteAddr = "10.0.0.1:4000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+
+	if got := s.httpClientAddr(r); got != r.RemoteAddr {
+		t.Errorf("TLS mode: client %q, want the peer %q", got, r.RemoteAddr)
+	}
+	s.dohPlain = true
+	if got := s.httpClientAddr(r); got != "203.0.113.7" {
+		t.Errorf("plain mode: client %q, want the first X-Forwarded-For entry", got)
+	}
+	r.Header.Del("X-Forwarded-For")
+	if got := s.httpClientAddr(r); got != r.RemoteAddr {
+		t.Errorf("plain mode without the header: client %q, want %q", got, r.RemoteAddr)
+	}
+}
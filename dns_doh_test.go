@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeDoHServer answers every DoH query with an A record for
+// 192.0.2.80, letting headers adjust the HTTP response and pick its status.
+// The returned client trusts the server's certificate.
+func startFakeDoHServer(t *testing.T, usePOST bool, headers func(w http.ResponseWriter) int) *dohClient {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var raw []byte
+		var err error
+		switch r.Method {
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dnsMessageType {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			raw, err = io.ReadAll(r.Body)
+		case http.MethodGet:
+			raw, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		}
+		if usePOST != (r.Method == http.MethodPost) {
+			http.Error(w, "wrong method "+r.Method, http.StatusMethodNotAllowed)
+			return
+		}
+		q, perr := FromBytes(raw)
+		if err != nil || perr != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		data, _ := reply(q, NOERROR, mustA(t, q.Questions[0].Name, "192.0.2.80")).ToBytes()
+		w.Header().Set("Content-Type", dnsMessageType)
+		status := http.StatusOK
+		if headers != nil {
+			status = headers(w)
+		}
+		w.WriteHeader(status)
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	d := newDoHClient(srv.URL+DefaultDoHPath, usePOST, &tls.Config{RootCAs: roots}, nil)
+	t.Cleanup(d.close)
+	return d
+}
+
+func TestDoHClientMethods(t *testing.T) {
+	for _, usePOST := range []bool{false, true} {
+		d := startFakeDoHServer(t, usePOST, nil)
+		resp, err := d.exchange(aQuery("example.com"), false, time.Second)
+		if err != nil {
+			t.Fatalf("POST %v: %v", usePOST, err)
+		}
+		if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.80" || resp.Answers[0].TTL != 300 {
+			t.Fatalf("POST %v: got answers %v with TTL %d, want [192.0.2.80] with 300", usePOST, ips, resp.Answers[0].TTL)
+		}
+	}
+}
+
+func TestDoHClientHTTPFreshness(t *testing.T) {
+	tests := []struct {
+		cacheControl, age string
+		wantTTL           uint32
+	}{
+		{"max-age=100", "", 100},
+		{"max-age=100", "30", 70},
+		{"", "30", 270},
+		{"max-age=1000", "", 300},
+		{"max-age=100", "200", 0},
+		{"no-cache", "", 0},
+	}
+	for _, tt := range tests {
+		d := startFakeDoHServer(t, true, func(w http.ResponseWriter) int {
+			if tt.cacheControl != "" {
+				w.Header().Set("Cache-Control", tt.cacheControl)
+			}
+			if tt.age != "" {
+				w.Header().Set("Age", tt.age)
+			}
+			return http.StatusOK
+		})
+		resp, err := d.exchange(aQuery("example.com"), false, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl := resp.Answers[0].TTL; ttl != tt.wantTTL {
+			t.Errorf("Cache-Control %q, Age %q: TTL %d, want %d", tt.cacheControl, tt.age, ttl, tt.wantTTL)
+		}
+	}
+}
+
+func TestDoHClientRejectsBadResponses(t *testing.T) {
+	tests := []struct {
+		desc    string
+		headers func(w http.ResponseWriter) int
+		want    string
+	}{
+		{"server error", func(w http.ResponseWriter) int { return http.StatusInternalServerError }, "HTTP status 500"},
+		{"not found", func(w http.ResponseWriter) int { return http.StatusNotFound }, "HTTP status 404"},
+		{"content type", func(w http.ResponseWriter) int {
+			w.Header().Set("Content-Type", "text/html")
+			return http.StatusOK
+		}, "unexpected content type"},
+	}
+	for _, tt := range tests {
+		d := startFakeDoHServer(t, false, tt.headers)
+		_, err := d.exchange(aQuery("example.com"), false, time.Second)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.desc, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDoTPort        = "853"
+	DefaultDoTIdleTimeout = 30 * time.Second
+)
+
+var errDoTConnClosed = errors.New("DoT connection closed")
+
+// dotClient sends queries to one DNS-over-TLS upstream (RFC 7858) over a
+// persistent connection. Queries are pipelined: each is written as soon as
+// it arrives and responses, which may come back in any order, are matched
+// to their query by ID. The connection is closed after idleTimeout without
+// outstanding queries, or when a query times out without the server
+// sending anything meanwhile, and redialed on the next one.
+type dotClient struct {
+	addr        string
+	config      *tls.Config
+	idleTimeout time.Duration
+
+	mu   sync.Mutex
+	conn *dotConn
+}
+
+// dotConn is one TLS connection together with its outstanding queries
+type dotConn struct {
+	conn net.Conn
+	wmu  sync.Mutex // serializes writes
+
+	mu          sync.Mutex
+	pending     map[uint16]chan *DnsPacket
+	closed      bool
+	err         error
+	lastRead    time.Time // when the server last sent anything
+	idle        *time.Timer
+	idleTimeout time.Duration
+}
+
+func newDoTClient(addr string, config *tls.Config) *dotClient {
+	return &dotClient{addr: addr, config: config, idleTimeout: DefaultDoTIdleTimeout}
+}
+
+// upstreamTLSConfig builds the TLS configuration for an encrypted upstream.
+// The server certificate is verified against authName (RFC 8310
+// authentication domain name) using the system roots or the PEM bundle in
+// caFile; pins are base64 SHA-256 hashes of SubjectPublicKeyInfo (RFC 7469
+// pin-sha256), one of which must match a certificate in the verified chain.
+func upstreamTLSConfig(authName, caFile string, pins []string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: authName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if len(pins) > 0 {
+		want := make(map[[sha256.Size]byte]bool, len(pins))
+		for _, p := range pins {
+			raw, err := base64.StdEncoding.DecodeString(p)
+			if err != nil || len(raw) != sha256.Size {
+				return nil, fmt.Errorf("bad SPKI pin %q", p)
+			}
+			want[[sha256.Size]byte(raw)] = true
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					if want[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+						return nil
+					}
+				}
+			}
+			return errors.New("no certificate matches the SPKI pin")
+		}
+	}
+	return config, nil
+}
+
+// exchange sends query over the shared connection and waits up to timeout
+// for its answer. A connection the server closed while idle is redialed
+// once.
+func (d *dotClient) exchange(query *DnsPacket, exactCase bool, timeout time.Duration) (*DnsPacket, error) {
+	for attempt := 0; ; attempt++ {
+		c, err := d.connection(timeout)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.roundTrip(query, exactCase, timeout)
+		if errors.Is(err, errDoTConnClosed) && attempt == 0 {
+			continue
+		}
+		return resp, err
+	}
+}
+
+// connection returns the open connection, dialing a new one if needed
+func (d *dotClient) connection(timeout time.Duration) (*dotConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil && !d.conn.isClosed() {
+		return d.conn, nil
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", d.addr, d.config)
+	if err != nil {
+		return nil, err
+	}
+	c := &dotConn{conn: conn, pending: make(map[uint16]chan *DnsPacket), idleTimeout: d.idleTimeout}
+	c.idle = time.AfterFunc(d.idleTimeout, c.closeIfIdle)
+	go c.readLoop()
+	d.conn = c
+	log.Printf("🔒 DoT connection to %s established (%s)", d.addr, tls.VersionName(conn.ConnectionState().Version))
+	return c, nil
+}
+
+// close shuts the current connection down
+func (d *dotClient) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil {
+		d.conn.fail(errDoTConnClosed)
+		d.conn = nil
+	}
+}
+
+// roundTrip sends query under an ID not already outstanding on this
+// connection and waits for the matching response
+func (c *dotConn) roundTrip(query *DnsPacket, exactCase bool, timeout time.Duration) (*DnsPacket, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errDoTConnClosed
+	}
+	id := randomID()
+	for c.pending[id] != nil {
+		id = randomID()
+	}
+	query.Header.ID = id
+	ch := make(chan *DnsPacket, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer c.done(id)
+
+	raw, err := query.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	sent := time.Now()
+	c.wmu.Lock()
+	c.conn.SetWriteDeadline(sent.Add(timeout))
+	err = writeTCPMessage(c.conn, raw)
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, fmt.Errorf("%w: %v", errDoTConnClosed, err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("%w: %v", errDoTConnClosed, c.err)
+		}
+		if err := checkResponse(query, resp, exactCase); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	case <-timer.C:
+		c.mu.Lock()
+		silent := c.lastRead.Before(sent)
+		c.mu.Unlock()
+		if silent {
+			// nothing came back for any query while this one waited, so
+			// the connection is most likely dead; the next query redials
+			c.fail(errDoTConnClosed)
+		}
+		return nil, fmt.Errorf("DoT query to %s timed out", c.conn.RemoteAddr())
+	}
+}
+
+// done forgets a finished query and restarts the idle timer once nothing
+// is outstanding
+func (c *dotConn) done(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+	if len(c.pending) == 0 && !c.closed {
+		c.idle.Reset(c.idleTimeout)
+	}
+}
+
+// readLoop delivers responses to whichever query is waiting for their ID
+func (c *dotConn) readLoop() {
+	for {
+		msg, err := readTCPMessage(c.conn)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		resp, err := FromBytes(msg)
+		if err != nil {
+			log.Printf("⚠️ Discarded unparsable DoT response from %s: %v", c.conn.RemoteAddr(), err)
+			continue
+		}
+		c.mu.Lock()
+		c.lastRead = time.Now()
+		ch := c.pending[resp.Header.ID]
+		delete(c.pending, resp.Header.ID)
+		c.mu.Unlock()
+		if ch == nil {
+			log.Printf("⚠️ Discarded DoT response with unknown ID %d from %s", resp.Header.ID, c.conn.RemoteAddr())
+			continue
+		}
+		ch <- resp
+	}
+}
+
+func (c *dotConn) closeIfIdle() {
+	c.mu.Lock()
+	busy := len(c.pending) > 0
+	c.mu.Unlock()
+	if !busy {
+		c.fail(errDoTConnClosed)
+	}
+}
+
+// fail closes the connection and wakes every query still waiting on it
+func (c *dotConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.err = err
+	c.idle.Stop()
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *dotConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
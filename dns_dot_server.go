@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDoTListenPort = 853
+	DefaultDoTServerIdle = 30 * time.Second
+	DefaultDoTMaxConns   = 1000
+)
+
+// certReloader serves the certificate in certFile/keyFile and picks up a
+// replaced pair on the next handshake, so certificates can be renewed
+// without a restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A pair that fails to
+// load keeps the previous certificate in service.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	modTime, err := r.latestModTime()
+	if err != nil && r.cert == nil {
+		return nil, err
+	}
+	if err == nil && !modTime.Equal(r.modTime) {
+		cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		switch {
+		case err == nil:
+			if r.cert != nil {
+				log.Printf("🔒 Reloaded TLS certificate from %s", r.certFile)
+			}
+			r.cert, r.modTime = &cert, modTime
+		case r.cert == nil:
+			return nil, err
+		default:
+			log.Printf("❌ Failed to reload TLS certificate, keeping the old one: %v", err)
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		st, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if st.ModTime().After(latest) {
+			latest = st.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// startDoTServer listens for DNS-over-TLS clients (RFC 7858)
+func (s *DnsServer) startDoTServer() error {
+	certs, err := newCertReloader(s.tlsCertFile, s.tlsKeyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	addr := fmt.Sprintf("0.0.0.0:%d", s.dotPort)
+	ln, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return fmt.Errorf("failed to bind DoT port %d: %w", s.dotPort, err)
+	}
+	log.Printf("🔒 DNS-over-TLS Server started on %s", addr)
+
+	go s.acceptStreams(ln, "DoT", s.dotMaxConns, s.dotIdleTimeout)
+	return nil
+}
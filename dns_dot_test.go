@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// selfSignedCert returns a certificate for name signed by itself, which is
+// also its own CA, and the path of a PEM file holding it
+func selfSignedCert(t *testing.T, name string) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+// fakeDoTServer is a local DNS-over-TLS stand-in. While silent, a
+// connection that receives a query goes dead: it stays open but is never
+// read from or answered again, like a blackholed path.
+type fakeDoTServer struct {
+	addr    string
+	caFile  string
+	accepts atomic.Int32
+	silent  atomic.Bool
+	stop    chan struct{}
+}
+
+func startFakeDoTServer(t *testing.T, handle func(q *DnsPacket) *DnsPacket) *fakeDoTServer {
+	t.Helper()
+	cert, caFile := selfSignedCert(t, "dns.test")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeDoTServer{addr: ln.Addr().String(), caFile: caFile, stop: make(chan struct{})}
+	t.Cleanup(func() {
+		ln.Close()
+		close(s.stop)
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.accepts.Add(1)
+			go s.serve(conn, handle)
+		}
+	}()
+	return s
+}
+
+func (s *fakeDoTServer) serve(conn net.Conn, handle func(q *DnsPacket) *DnsPacket) {
+	defer conn.Close()
+	for {
+		msg, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		if s.silent.Load() {
+			<-s.stop
+			return
+		}
+		q, err := FromBytes(msg)
+		if err != nil {
+			continue
+		}
+		data, err := handle(q).ToBytes()
+		if err != nil {
+			return
+		}
+		if err := writeTCPMessage(conn, data); err != nil {
+			return
+		}
+	}
+}
+
+func TestDoTUpstreamWithPrivateCA(t *testing.T) {
+	s := startFakeDoTServer(t, func(q *DnsPacket) *DnsPacket {
+		return reply(q, NOERROR, mustA(t, q.Questions[0].Name, "192.0.2.53"))
+	})
+	u, err := ParseUpstream("tls://"+s.addr+"?name=dns.test&ca="+s.caFile, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.dot.close()
+
+	for range 3 {
+		resp, err := u.exchange(aQuery("example.com"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.53" {
+			t.Fatalf("got answers %v, want [192.0.2.53]", ips)
+		}
+	}
+	if n := s.accepts.Load(); n != 1 {
+		t.Fatalf("server accepted %d connections, want 1 reused connection", n)
+	}
+}
+
+func TestDoTUpstreamRejectsUnknownCA(t *testing.T) {
+	s := startFakeDoTServer(t, func(q *DnsPacket) *DnsPacket { return reply(q, NOERROR) })
+	_, otherCA := selfSignedCert(t, "dns.test")
+	u, err := ParseUpstream("tls://"+s.addr+"?name=dns.test&ca="+otherCA, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.exchange(aQuery("example.com"), false); err == nil {
+		t.Fatal("connected to a server whose certificate isn't signed by the configured CA")
+	}
+}
+
+func TestDoTUpstreamRedialsAfterSilentTimeout(t *testing.T) {
+	s := startFakeDoTServer(t, func(q *DnsPacket) *DnsPacket {
+		return reply(q, NOERROR, mustA(t, q.Questions[0].Name, "192.0.2.53"))
+	})
+	u, err := ParseUpstream("tls://"+s.addr+"?name=dns.test&ca="+s.caFile, 200*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.dot.close()
+
+	s.silent.Store(true)
+	if _, err := u.exchange(aQuery("example.com"), false); err == nil {
+		t.Fatal("query to a silent server succeeded")
+	}
+	s.silent.Store(false)
+	if _, err := u.exchange(aQuery("example.com"), false); err != nil {
+		t.Fatalf("query after the server recovered: %v", err)
+	}
+	if n := s.accepts.Load(); n != 2 {
+		t.Fatalf("server accepted %d connections, want the dead one replaced", n)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// EdnsVersion is the highest EDNS version we implement
+	EdnsVersion = 0
+	// DefaultEDNSSize avoids IP fragmentation on common paths (DNS flag day 2020)
+	DefaultEDNSSize = 1232
+
+	ednsFlagDO = 0x8000
+
+	ednsOptionTCPKeepalive = 11 // RFC 7828
+)
+
+// EdnsOption is a single {code, data} pair from the OPT RDATA
+type EdnsOption struct {
+	Code uint16
+	Data []byte
+}
+
+// Edns is the parsed OPT pseudo-record (RFC 6891). It is kept out of
+// DnsPacket.Resources and re-added when the packet is written.
+type Edns struct {
+	UDPSize  uint16
+	ExtRCode uint8 // upper 8 bits of the 12-bit RCODE
+	Version  uint8
+	DO       bool   // DNSSEC OK (RFC 3225)
+	Z        uint16 // remaining flag bits, must be zero
+	Options  []EdnsOption
+}
+
+// ednsFromRecord decodes an OPT record
+func ednsFromRecord(r *DnsRecord) (*Edns, error) {
+	if r.Name != "" {
+		return nil, errors.New("OPT owner must be root")
+	}
+	e := &Edns{
+		UDPSize:  uint16(r.Class),
+		ExtRCode: uint8(r.TTL >> 24),
+		Version:  uint8(r.TTL >> 16),
+		DO:       r.TTL&ednsFlagDO != 0,
+		Z:        uint16(r.TTL) &^ ednsFlagDO,
+	}
+	var data []byte
+	if op, ok := r.RData.(*RDataOpaque); ok {
+		data = op.Data
+	}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("short EDNS option")
+		}
+		code := binary.BigEndian.Uint16(data[0:2])
+		l := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+l {
+			return nil, errors.New("EDNS option overflows rdata")
+		}
+		opt := EdnsOption{Code: code, Data: make([]byte, l)}
+		copy(opt.Data, data[4:4+l])
+		e.Options = append(e.Options, opt)
+		data = data[4+l:]
+	}
+	return e, nil
+}
+
+// record encodes the OPT pseudo-record
+func (e *Edns) record() *DnsRecord {
+	ttl := uint32(e.ExtRCode)<<24 | uint32(e.Version)<<16 | uint32(e.Z&^ednsFlagDO)
+	if e.DO {
+		ttl |= ednsFlagDO
+	}
+	data := []byte{}
+	for _, o := range e.Options {
+		data = binary.BigEndian.AppendUint16(data, o.Code)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(o.Data)))
+		data = append(data, o.Data...)
+	}
+	return &DnsRecord{
+		Name:  "",
+		Type:  QTypeOPT,
+		Class: QClass(e.UDPSize),
+		TTL:   ttl,
+		RData: &RDataOpaque{Data: data},
+	}
+}
+
+// option returns the first option with the given code
+func (e *Edns) option(code uint16) (EdnsOption, bool) {
+	if e == nil {
+		return EdnsOption{}, false
+	}
+	for _, o := range e.Options {
+		if o.Code == code {
+			return o, true
+		}
+	}
+	return EdnsOption{}, false
+}
+
+// payloadSize returns the UDP payload size a requester can accept, never
+// below the RFC 1035 minimum of 512
+func (e *Edns) payloadSize() int {
+	if e == nil || e.UDPSize < MaxPacketSize {
+		return MaxPacketSize
+	}
+	return int(e.UDPSize)
+}
+
+// filterDNSSEC drops DNSSEC records that weren't explicitly asked for when
+// the requester didn't set the DO bit (RFC 3225 3)
+func filterDNSSEC(records []*DnsRecord, qtype QType, dnssecOK bool) []*DnsRecord {
+	if dnssecOK {
+		return records
+	}
+	out := make([]*DnsRecord, 0, len(records))
+	for _, r := range records {
+		switch r.Type {
+		case QTypeRRSIG, QTypeNSEC, QTypeNSEC3:
+			if r.Type != qtype {
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
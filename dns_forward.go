@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ForwardTable maps domain suffixes to the upstream pools responsible for
+// them. A question goes to the pool of the longest suffix matching on label
+// boundaries, so "corp.example" covers "a.corp.example" but not
+// "notcorp.example"; names matching no suffix use the resolver's default pool.
+//
+// The cache is not partitioned by forwarder: entries are keyed by question
+// alone. Every name maps to exactly one pool, so answers from different
+// forwarders never share a key, and serve-stale and prefetch refreshes go
+// back to the same forwarder. Changing the table at runtime would leave
+// answers from the previous forwarder cached until they expire.
+type ForwardTable struct {
+	zones map[string]*UpstreamPool // lower-cased suffix without trailing dot
+}
+
+func NewForwardTable() *ForwardTable {
+	return &ForwardTable{zones: make(map[string]*UpstreamPool)}
+}
+
+// Add forwards suffix and everything below it to pool
+func (t *ForwardTable) Add(suffix string, pool *UpstreamPool) {
+	t.zones[normalizeName(suffix)] = pool
+}
+
+// Lookup returns the pool for the longest suffix of name in the table
+func (t *ForwardTable) Lookup(name string) (*UpstreamPool, string, bool) {
+	if t == nil || len(t.zones) == 0 {
+		return nil, "", false
+	}
+	name = normalizeName(name)
+	for {
+		if pool, ok := t.zones[name]; ok {
+			return pool, name, true
+		}
+		if name == "" {
+			return nil, "", false
+		}
+		name = parentName(name)
+	}
+}
+
+// Pools returns every pool in the table
+func (t *ForwardTable) Pools() []*UpstreamPool {
+	pools := make([]*UpstreamPool, 0, len(t.zones))
+	for _, p := range t.zones {
+		pools = append(pools, p)
+	}
+	return pools
+}
+
+func (t *ForwardTable) String() string {
+	parts := make([]string, 0, len(t.zones))
+	for zone, pool := range t.zones {
+		parts = append(parts, fmt.Sprintf("%s → %s", fqdn(zone), pool))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// ParseForward parses "suffix=upstream[,upstream...]" into a suffix and a
+// pool using the given policy and per-upstream defaults
+func ParseForward(spec string, policy UpstreamPolicy, timeout time.Duration, retries int) (string, *UpstreamPool, error) {
+	suffix, list, ok := strings.Cut(spec, "=")
+	if !ok || list == "" {
+		return "", nil, fmt.Errorf("forward %q: want suffix=upstream[,upstream...]", spec)
+	}
+	var ups []*Upstream
+	for _, s := range strings.Split(list, ",") {
+		u, err := ParseUpstream(strings.TrimSpace(s), timeout, retries)
+		if err != nil {
+			return "", nil, fmt.Errorf("forward %q: %w", spec, err)
+		}
+		ups = append(ups, u)
+	}
+	return suffix, NewUpstreamPool(ups, policy), nil
+}
+
+// normalizeName lower-cases a name and strips the trailing dot
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// parentName strips the leftmost label from a normalized name; the parent
+// of a single label is the root, ""
+func parentName(name string) string {
+	_, parent, _ := strings.Cut(name, ".")
+	return parent
+}
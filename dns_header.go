@@ -1,26 +1,83 @@
 package main
 
-type RCode uint8
+import (
+	"fmt"
+	"strings"
+)
+
+// RCode is a response code. Only the low 4 bits fit the header; EDNS carries
+// the upper 8 of the 12-bit value (RFC 6891 6.1.3).
+type RCode uint16
 
 const (
-	NOERROR RCode = 0
-	FORMERR RCode = 1
+	NOERROR  RCode = 0
+	FORMERR  RCode = 1
 	SERVFAIL RCode = 2
 	NXDOMAIN RCode = 3
 	NOTIMPL  RCode = 4
 	REFUSED  RCode = 5
+	YXDOMAIN RCode = 6
+	YXRRSET  RCode = 7
+	NXRRSET  RCode = 8
+	NOTAUTH  RCode = 9
+	NOTZONE  RCode = 10
+
+	// extended RCODEs, only representable with an OPT record (RFC 6891)
+	BADVERS   RCode = 16
+	BADKEY    RCode = 17
+	BADTIME   RCode = 18
+	BADMODE   RCode = 19
+	BADNAME   RCode = 20
+	BADALG    RCode = 21
+	BADTRUNC  RCode = 22
+	BADCOOKIE RCode = 23
 )
 
+var rcodeNames = map[RCode]string{
+	NOERROR: "NOERROR", FORMERR: "FORMERR", SERVFAIL: "SERVFAIL",
+	NXDOMAIN: "NXDOMAIN", NOTIMPL: "NOTIMP", REFUSED: "REFUSED",
+	YXDOMAIN: "YXDOMAIN", YXRRSET: "YXRRSET", NXRRSET: "NXRRSET",
+	NOTAUTH: "NOTAUTH", NOTZONE: "NOTZONE", BADVERS: "BADVERS",
+	BADKEY: "BADKEY", BADTIME: "BADTIME", BADMODE: "BADMODE",
+	BADNAME: "BADNAME", BADALG: "BADALG", BADTRUNC: "BADTRUNC",
+	BADCOOKIE: "BADCOOKIE",
+}
+
+var rcodeByName = reverseNames(rcodeNames)
+
+func (rc RCode) String() string {
+	if name, ok := rcodeNames[rc]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", uint8(rc))
+}
+
+// ParseRCode parses an rcode mnemonic or the RCODEnn form
+func ParseRCode(s string) (RCode, error) {
+	u := strings.ToUpper(s)
+	if rc, ok := rcodeByName[u]; ok {
+		return rc, nil
+	}
+	if u == "NOTIMPL" {
+		return NOTIMPL, nil
+	}
+	n, err := parseGenericNumber(u, "RCODE", 12)
+	if err != nil {
+		return 0, fmt.Errorf("unknown rcode %q", s)
+	}
+	return RCode(n), nil
+}
+
 type DnsHeader struct {
-	ID               uint16
-	Response         bool
-	Opcode           uint8
-	Authoritative    bool
-	Truncated        bool
-	RecursionDesired bool
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
 	RecursionAvailable bool
-	Z                uint8
-	RESCODE          RCode
+	Z                  uint8
+	RESCODE            RCode
 
 	QDCount uint16
 	ANCount uint16
@@ -30,7 +87,7 @@ type DnsHeader struct {
 
 func NewDnsHeader() *DnsHeader {
 	return &DnsHeader{
-		Opcode: 0,
+		Opcode:  0,
 		QDCount: 0,
 		ANCount: 0,
 		NSCount: 0,
@@ -41,10 +98,14 @@ func NewDnsHeader() *DnsHeader {
 
 func (h *DnsHeader) Read(buf *BytePacketBuffer) error {
 	id, err := buf.ReadUint16()
-	if err != nil { return err }
+	if err != nil {
+		return err
+	}
 	h.ID = id
 	flags, err := buf.ReadUint16()
-	if err != nil { return err }
+	if err != nil {
+		return err
+	}
 	h.Response = (flags & 0x8000) != 0
 	h.Opcode = uint8((flags >> 11) & 0x0F)
 	h.Authoritative = (flags & 0x0400) != 0
@@ -66,21 +127,43 @@ func (h *DnsHeader) Read(buf *BytePacketBuffer) error {
 }
 
 func (h *DnsHeader) Write(buf *BytePacketBuffer) error {
-	if err := buf.WriteUint16(h.ID); err != nil { return err }
+	if err := buf.WriteUint16(h.ID); err != nil {
+		return err
+	}
 	var flags uint16 = 0
-	if h.Response { flags |= 0x8000 }
+	if h.Response {
+		flags |= 0x8000
+	}
 	flags |= (uint16(h.Opcode&0x0F) << 11)
-	if h.Authoritative { flags |= 0x0400 }
-	if h.Truncated { flags |= 0x0200 }
-	if h.RecursionDesired { flags |= 0x0100 }
-	if h.RecursionAvailable { flags |= 0x0080 }
+	if h.Authoritative {
+		flags |= 0x0400
+	}
+	if h.Truncated {
+		flags |= 0x0200
+	}
+	if h.RecursionDesired {
+		flags |= 0x0100
+	}
+	if h.RecursionAvailable {
+		flags |= 0x0080
+	}
 	flags |= (uint16(h.Z&0x7) << 4)
 	flags |= uint16(h.RESCODE & 0x0F)
 
-	if err := buf.WriteUint16(flags); err != nil { return err }
-	if err := buf.WriteUint16(h.QDCount); err != nil { return err }
-	if err := buf.WriteUint16(h.ANCount); err != nil { return err }
-	if err := buf.WriteUint16(h.NSCount); err != nil { return err }
-	if err := buf.WriteUint16(h.ARCount); err != nil { return err }
+	if err := buf.WriteUint16(flags); err != nil {
+		return err
+	}
+	if err := buf.WriteUint16(h.QDCount); err != nil {
+		return err
+	}
+	if err := buf.WriteUint16(h.ANCount); err != nil {
+		return err
+	}
+	if err := buf.WriteUint16(h.NSCount); err != nil {
+		return err
+	}
+	if err := buf.WriteUint16(h.ARCount); err != nil {
+		return err
+	}
 	return nil
 }
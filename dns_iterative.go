@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultIterativeMaxDepth     = 6  // nested lookups of nameserver addresses
+	DefaultIterativeMaxReferrals = 16 // referrals followed for one name
+	DefaultIterativeMaxQueries   = 64 // queries sent for one client question
+	DefaultIterativeMaxCNAMEs    = 8
+	DefaultDelegationCacheSize   = 10000
+)
+
+// RootHints are the IPv4 addresses of the root servers a.root-servers.net
+// through m.root-servers.net (IANA named.root)
+var RootHints = []string{
+	"198.41.0.4:53",
+	"170.247.170.2:53",
+	"192.33.4.12:53",
+	"199.7.91.13:53",
+	"192.203.230.10:53",
+	"192.5.5.241:53",
+	"192.112.36.4:53",
+	"198.97.190.53:53",
+	"192.36.148.17:53",
+	"192.58.128.30:53",
+	"193.0.14.129:53",
+	"199.7.83.42:53",
+	"202.12.27.33:53",
+}
+
+var (
+	errQueryLimit    = errors.New("iterative resolution exceeded the query limit")
+	errDepthLimit    = errors.New("iterative resolution exceeded the depth limit")
+	errReferralLimit = errors.New("iterative resolution exceeded the referral limit")
+	errCNAMELimit    = errors.New("CNAME chain too long")
+)
+
+// IterativeResolver resolves names itself, starting at the root servers and
+// following referrals down to the authoritative servers (RFC 1034 5.3.3)
+// instead of relying on a recursive upstream.
+type IterativeResolver struct {
+	roots    []string // root server addresses (host:port)
+	port     string   // port used for nameservers learned from referrals
+	timeout  time.Duration
+	ednsSize uint16
+	dnssecOK bool
+	use0x20  bool
+
+	maxDepth     int
+	maxReferrals int
+	maxQueries   int
+	maxCNAMEs    int
+
+	mu             sync.Mutex
+	delegations    map[string]*delegation // zone → nameservers
+	maxDelegations int
+}
+
+// delegation is a cached zone cut together with its nameserver addresses
+type delegation struct {
+	zone    string
+	servers []string
+	expiry  time.Time
+}
+
+// iterState is the budget shared by every lookup made for one client
+// question, including nested lookups of nameserver addresses
+type iterState struct {
+	queries int
+}
+
+// NewIterativeResolver creates a resolver starting from the given root
+// server addresses, normally RootHints
+func NewIterativeResolver(roots []string) *IterativeResolver {
+	return &IterativeResolver{
+		roots:    roots,
+		port:     "53",
+		timeout:  DefaultUpstreamTimeout,
+		ednsSize: DefaultEDNSSize,
+		dnssecOK: true,
+
+		maxDepth:     DefaultIterativeMaxDepth,
+		maxReferrals: DefaultIterativeMaxReferrals,
+		maxQueries:   DefaultIterativeMaxQueries,
+		maxCNAMEs:    DefaultIterativeMaxCNAMEs,
+
+		delegations:    make(map[string]*delegation),
+		maxDelegations: DefaultDelegationCacheSize,
+	}
+}
+
+// Resolve looks up name/qtype from the closest known delegation and returns
+// the final answer with any CNAME chain leading to it
+func (r *IterativeResolver) Resolve(name string, qtype QType) (*DnsPacket, error) {
+	return r.resolve(name, qtype, &iterState{}, 0)
+}
+
+func (r *IterativeResolver) resolve(name string, qtype QType, st *iterState, depth int) (*DnsPacket, error) {
+	if depth > r.maxDepth {
+		return nil, errDepthLimit
+	}
+	result := NewDnsPacket()
+	result.Header.Response = true
+	result.Questions = append(result.Questions, &DnsQuestion{Name: name, QType: qtype, QClass: QClassIN})
+
+	target := name
+	for hops := 0; ; hops++ {
+		resp, err := r.resolveName(target, qtype, st, depth)
+		if err != nil {
+			return nil, err
+		}
+		chain, next := followCNAMEs(resp.Answers, target, qtype)
+		result.Answers = append(result.Answers, chain...)
+		result.Authorities = resp.Authorities
+		result.Resources = resp.Resources
+		result.Header.RESCODE = resp.Header.RESCODE
+		if next == "" || resp.Header.RESCODE != NOERROR {
+			return result, nil
+		}
+		// the chain leaves the answering zone, resolve the rest from scratch
+		if hops >= r.maxCNAMEs {
+			return nil, errCNAMELimit
+		}
+		target = next
+	}
+}
+
+// resolveName follows referrals for name until a server answers it
+func (r *IterativeResolver) resolveName(name string, qtype QType, st *iterState, depth int) (*DnsPacket, error) {
+	zone, servers := r.closest(name)
+	for referrals := 0; ; referrals++ {
+		if referrals > r.maxReferrals {
+			return nil, errReferralLimit
+		}
+		resp, err := r.queryZone(zone, servers, name, qtype, st)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Header.RESCODE != NOERROR || len(resp.Answers) > 0 {
+			return resp, nil
+		}
+		child, hosts, ttl := findReferral(resp, zone, name)
+		if child == "" {
+			// no answer and no closer delegation: NODATA
+			return resp, nil
+		}
+
+		addrs := r.glue(resp, zone, hosts)
+		if len(addrs) == 0 {
+			if addrs, err = r.resolveNameservers(hosts, st, depth); err != nil {
+				return nil, fmt.Errorf("resolving nameservers of %s: %w", fqdn(child), err)
+			}
+		}
+		r.cacheDelegation(child, addrs, ttl)
+		zone, servers = child, addrs
+	}
+}
+
+// queryZone asks the nameservers of zone in random order until one of them
+// gives a usable answer
+func (r *IterativeResolver) queryZone(zone string, servers []string, name string, qtype QType, st *iterState) (*DnsPacket, error) {
+	sent := name
+	if r.use0x20 {
+		sent = randomizeCase(name)
+	}
+	query := NewDnsPacket()
+	query.Questions = append(query.Questions, &DnsQuestion{Name: sent, QType: qtype, QClass: QClassIN})
+	if r.ednsSize > 0 {
+		query.Edns = &Edns{UDPSize: r.ednsSize, DO: r.dnssecOK}
+	}
+
+	order := make([]string, len(servers))
+	copy(order, servers)
+	rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+
+	lastErr := errors.New("no nameservers")
+	for _, addr := range order {
+		if st.queries >= r.maxQueries {
+			return nil, errQueryLimit
+		}
+		st.queries++
+		u := &Upstream{Addr: addr, Timeout: r.timeout}
+		resp, err := u.exchange(query, r.use0x20)
+		if err == nil && query.Edns != nil && resp.Header.RESCODE == FORMERR && resp.Edns == nil {
+			// the server doesn't understand EDNS; ask it again without
+			// (RFC 6891 7)
+			if st.queries >= r.maxQueries {
+				return nil, errQueryLimit
+			}
+			st.queries++
+			plain := *query
+			plain.Edns = nil
+			resp, err = u.exchange(&plain, r.use0x20)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch resp.Header.RESCODE {
+		case SERVFAIL, REFUSED, NOTIMPL, FORMERR:
+			// lame or broken server, try the next one
+			lastErr = fmt.Errorf("%s answered %s", addr, resp.Header.RESCODE)
+			continue
+		}
+		restoreCase(resp, sent, name)
+		scrubResponse(resp, name, qtype, zone)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no nameserver for %s answered %s: %w", fqdn(zone), fqdn(name), lastErr)
+}
+
+// glue returns the addresses given for hosts in the additional section.
+// Only addresses inside zone, the bailiwick of the server that sent them,
+// are trusted; only IPv4 glue is used.
+func (r *IterativeResolver) glue(resp *DnsPacket, zone string, hosts []string) []string {
+	wanted := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		wanted[normalizeName(h)] = true
+	}
+	var addrs []string
+	for _, rec := range resp.Resources {
+		a, ok := rec.RData.(*RDataA)
+		if !ok || !wanted[normalizeName(rec.Name)] || !inBailiwick(rec.Name, zone) {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(a.IP.String(), r.port))
+	}
+	return addrs
+}
+
+// resolveNameservers looks up the addresses of a delegation's nameservers
+// when the referral came without glue, stopping at the first that resolves
+func (r *IterativeResolver) resolveNameservers(hosts []string, st *iterState, depth int) ([]string, error) {
+	lastErr := errors.New("no nameservers")
+	for _, host := range hosts {
+		resp, err := r.resolve(host, QTypeA, st, depth+1)
+		if err != nil {
+			if errors.Is(err, errQueryLimit) || errors.Is(err, errDepthLimit) {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		var addrs []string
+		for _, rec := range resp.Answers {
+			if a, ok := rec.RData.(*RDataA); ok {
+				addrs = append(addrs, net.JoinHostPort(a.IP.String(), r.port))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+		lastErr = fmt.Errorf("%s has no address", fqdn(host))
+	}
+	return nil, lastErr
+}
+
+// closest returns the deepest cached delegation enclosing name, or the root
+func (r *IterativeResolver) closest(name string) (string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	zone := normalizeName(name)
+	for zone != "" {
+		if d, ok := r.delegations[zone]; ok {
+			if now.Before(d.expiry) {
+				return d.zone, d.servers
+			}
+			delete(r.delegations, zone)
+		}
+		zone = parentName(zone)
+	}
+	return "", r.roots
+}
+
+// cacheDelegation remembers the nameservers of zone for ttl seconds
+func (r *IterativeResolver) cacheDelegation(zone string, servers []string, ttl uint32) {
+	if ttl == 0 || len(servers) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.delegations) >= r.maxDelegations {
+		now := time.Now()
+		for k, d := range r.delegations {
+			if !now.Before(d.expiry) {
+				delete(r.delegations, k)
+			}
+		}
+		if len(r.delegations) >= r.maxDelegations {
+			return
+		}
+	}
+	zone = normalizeName(zone)
+	r.delegations[zone] = &delegation{
+		zone:    zone,
+		servers: servers,
+		expiry:  time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	log.Printf("📡 Cached delegation %s → %d nameservers (TTL %ds)", fqdn(zone), len(servers), ttl)
+}
+
+// findReferral picks the NS set in the authority section that delegates
+// name to a zone below the one just queried, returning the child zone, its
+// nameserver names and the smallest NS TTL. Upward or sideways referrals
+// are ignored.
+func findReferral(resp *DnsPacket, zone, name string) (string, []string, uint32) {
+	var child string
+	var hosts []string
+	var ttl uint32
+	for _, rec := range resp.Authorities {
+		ns, ok := rec.RData.(*RDataNS)
+		if !ok {
+			continue
+		}
+		owner := normalizeName(rec.Name)
+		if child == "" {
+			if owner == normalizeName(zone) || !inBailiwick(owner, zone) || !inBailiwick(name, owner) {
+				continue
+			}
+			child, ttl = owner, rec.TTL
+		}
+		if owner != child {
+			continue
+		}
+		hosts = append(hosts, ns.Host)
+		ttl = min(ttl, rec.TTL)
+	}
+	return child, hosts, ttl
+}
+
+// followCNAMEs walks the answer section from name, returning the CNAMEs on
+// the way and the records answering the question. If the chain ends in a
+// CNAME whose target wasn't answered, that target is returned as next.
+func followCNAMEs(answers []*DnsRecord, name string, qtype QType) ([]*DnsRecord, string) {
+	var chain []*DnsRecord
+	current := normalizeName(name)
+	seen := map[string]bool{}
+	for !seen[current] {
+		seen[current] = true
+		var target string
+		var final, sigs []*DnsRecord
+		for _, rec := range answers {
+			if normalizeName(rec.Name) != current {
+				continue
+			}
+			switch {
+			case rec.Type == qtype || qtype == QTypeANY:
+				final = append(final, rec)
+			case rec.Type == QTypeRRSIG:
+				sigs = append(sigs, rec)
+			case rec.Type == QTypeCNAME:
+				cname, ok := rec.RData.(*RDataCNAME)
+				if !ok {
+					// malformed CNAME, never follow it
+					continue
+				}
+				chain = append(chain, rec)
+				target = cname.Target
+			}
+		}
+		chain = append(chain, sigs...)
+		if len(final) > 0 {
+			return append(chain, final...), ""
+		}
+		if target == "" {
+			if current == normalizeName(name) {
+				return chain, ""
+			}
+			return chain, current
+		}
+		current = normalizeName(target)
+	}
+	// CNAME loop
+	return chain, ""
+}
+
+// inBailiwick reports whether name is zone or below it
+func inBailiwick(name, zone string) bool {
+	name, zone = normalizeName(name), normalizeName(zone)
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
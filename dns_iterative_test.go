@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeAuthority is one authoritative server: the zones it serves map names
+// to A records, and delegations map child zones to a nameserver name and
+// its glue address
+type fakeAuthority struct {
+	records     map[string]string // name → IPv4 address
+	cnames      map[string]string // name → target
+	delegations map[string][2]string
+	noEDNS      bool // answer FORMERR without OPT to queries carrying EDNS
+}
+
+func (a *fakeAuthority) handle(q *DnsPacket) *DnsPacket {
+	if a.noEDNS && q.Edns != nil {
+		return reply(q, FORMERR)
+	}
+	name := normalizeName(q.Questions[0].Name)
+	if target, ok := a.cnames[name]; ok {
+		resp := reply(q, NOERROR, &DnsRecord{Name: name, Type: QTypeCNAME, Class: QClassIN, TTL: 300, RData: &RDataCNAME{Target: target}})
+		resp.Header.Authoritative = true
+		if ip, ok := a.records[target]; ok {
+			resp.Answers = append(resp.Answers, &DnsRecord{Name: target, Type: QTypeA, Class: QClassIN, TTL: 300, RData: &RDataA{IP: net.ParseIP(ip).To4()}})
+		}
+		return resp
+	}
+	if ip, ok := a.records[name]; ok {
+		resp := reply(q, NOERROR, &DnsRecord{Name: name, Type: QTypeA, Class: QClassIN, TTL: 300, RData: &RDataA{IP: net.ParseIP(ip).To4()}})
+		resp.Header.Authoritative = true
+		return resp
+	}
+	for zone, ns := range a.delegations {
+		if inBailiwick(name, zone) {
+			resp := reply(q, NOERROR)
+			resp.Authorities = append(resp.Authorities, &DnsRecord{Name: zone, Type: QTypeNS, Class: QClassIN, TTL: 3600, RData: &RDataNS{Host: ns[0]}})
+			if ns[1] != "" {
+				resp.Resources = append(resp.Resources, &DnsRecord{Name: ns[0], Type: QTypeA, Class: QClassIN, TTL: 3600, RData: &RDataA{IP: net.ParseIP(ns[1]).To4()}})
+			}
+			return resp
+		}
+	}
+	return reply(q, NXDOMAIN)
+}
+
+// startHierarchy starts a root on 127.0.0.1 and the given servers on
+// 127.0.0.2, 127.0.0.3, ... all on one port, and returns a resolver using
+// them
+func startHierarchy(t *testing.T, root *fakeAuthority, servers ...*fakeAuthority) (*IterativeResolver, []*fakeServer) {
+	t.Helper()
+	rs := startFakeServer(t, "127.0.0.1:0", root.handle)
+	_, port, _ := net.SplitHostPort(rs.addr)
+	all := []*fakeServer{rs}
+	for i, a := range servers {
+		ip := net.IPv4(127, 0, 0, byte(i+2)).String()
+		all = append(all, startFakeServer(t, net.JoinHostPort(ip, port), a.handle))
+	}
+	r := NewIterativeResolver([]string{rs.addr})
+	r.port = port
+	r.timeout = time.Second
+	return r, all
+}
+
+func answerIPs(p *DnsPacket) []string {
+	var ips []string
+	for _, rec := range p.Answers {
+		if a, ok := rec.RData.(*RDataA); ok {
+			ips = append(ips, a.IP.String())
+		}
+	}
+	return ips
+}
+
+func TestIterativeFollowsReferrals(t *testing.T) {
+	root := &fakeAuthority{delegations: map[string][2]string{"com": {"a.gtld.com", "127.0.0.2"}}}
+	com := &fakeAuthority{delegations: map[string][2]string{"example.com": {"ns1.example.com", "127.0.0.3"}}}
+	example := &fakeAuthority{records: map[string]string{
+		"www.example.com":  "192.0.2.10",
+		"mail.example.com": "192.0.2.11",
+	}}
+	r, servers := startHierarchy(t, root, com, example)
+
+	resp, err := r.Resolve("www.example.com", QTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.10" {
+		t.Fatalf("got answers %v, want [192.0.2.10]", ips)
+	}
+
+	// the delegation is cached, so the next name starts at example.com
+	rootQueries := servers[0].queries.Load()
+	if _, err := r.Resolve("mail.example.com", QTypeA); err != nil {
+		t.Fatal(err)
+	}
+	if got := servers[0].queries.Load(); got != rootQueries {
+		t.Fatalf("root queried %d more times, want cached delegation", got-rootQueries)
+	}
+}
+
+func TestIterativeResolvesNameserversWithoutGlue(t *testing.T) {
+	root := &fakeAuthority{delegations: map[string][2]string{
+		"example.com": {"ns.example.net", ""},
+		"example.net": {"ns.example.net", "127.0.0.2"},
+	}}
+	// one server answers for both zones
+	auth := &fakeAuthority{records: map[string]string{
+		"ns.example.net":  "127.0.0.2",
+		"www.example.com": "192.0.2.20",
+	}}
+	r, _ := startHierarchy(t, root, auth)
+
+	resp, err := r.Resolve("www.example.com", QTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.20" {
+		t.Fatalf("got answers %v, want [192.0.2.20]", ips)
+	}
+}
+
+func TestIterativeFollowsCNAMEOutOfZone(t *testing.T) {
+	root := &fakeAuthority{delegations: map[string][2]string{
+		"example.com": {"ns.example.com", "127.0.0.2"},
+		"example.net": {"ns.example.net", "127.0.0.3"},
+	}}
+	com := &fakeAuthority{cnames: map[string]string{"www.example.com": "web.example.net"}}
+	netZone := &fakeAuthority{records: map[string]string{"web.example.net": "192.0.2.30"}}
+	r, _ := startHierarchy(t, root, com, netZone)
+
+	resp, err := r.Resolve("www.example.com", QTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 2 || resp.Answers[0].Type != QTypeCNAME {
+		t.Fatalf("got %d answers, want the CNAME and its target", len(resp.Answers))
+	}
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.30" {
+		t.Fatalf("got answers %v, want [192.0.2.30]", ips)
+	}
+}
+
+func TestIterativeRetriesWithoutEDNS(t *testing.T) {
+	root := &fakeAuthority{delegations: map[string][2]string{"example.com": {"ns.example.com", "127.0.0.2"}}}
+	old := &fakeAuthority{records: map[string]string{"www.example.com": "192.0.2.40"}, noEDNS: true}
+	r, _ := startHierarchy(t, root, old)
+
+	resp, err := r.Resolve("www.example.com", QTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.40" {
+		t.Fatalf("got answers %v, want [192.0.2.40]", ips)
+	}
+}
+
+func TestIterativeRejectsOutOfBailiwickGlue(t *testing.T) {
+	// the com server tries to plant an address for a name outside com
+	com := &fakeAuthority{delegations: map[string][2]string{"example.com": {"ns.evil.net", "127.0.0.9"}}}
+	r := NewIterativeResolver(nil)
+	resp := com.handle(aQuery("www.example.com"))
+	hosts := []string{"ns.evil.net"}
+	if addrs := r.glue(resp, "com", hosts); len(addrs) != 0 {
+		t.Fatalf("trusted out-of-bailiwick glue %v", addrs)
+	}
+}
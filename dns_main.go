@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/binary"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -14,27 +19,103 @@ const (
 	DefaultPort   = 2053
 	UpstreamDNS   = "8.8.8.8:53"
 	MaxPacketSize = 512
+
+	// DefaultStaleAnswerTimeout is the client response timer after which a
+	// stale answer is served while upstream is still being asked (RFC 8767 5)
+	DefaultStaleAnswerTimeout = 1800 * time.Millisecond
+
+	// DefaultFailureRecheck is how long after a failed upstream lookup stale
+	// data is served without asking upstream again (RFC 8767 4)
+	DefaultFailureRecheck = 30 * time.Second
+
+	DefaultCacheSaveInterval = 5 * time.Minute
 )
 
 // DnsServer represents the DNS server
 type DnsServer struct {
-	port     int
-	cache    *DnsCache
-	resolver *DnsResolver
-	udpConn  *net.UDPConn
+	port       int
+	cache      *DnsCache
+	resolver   *DnsResolver
+	zones      *ZoneTable // served authoritatively, nil when none
+	udpConn    *net.UDPConn
+	maxUDPSize int // upper bound on the EDNS payload size we answer with
+
+	staleAnswerTimeout time.Duration
+	failureRecheck     time.Duration
+	refreshing         sync.Map   // cache keys with a background refresh in flight
+	failedAt           sync.Map   // cache key → time of its last failed upstream lookup
+	inflight           *Coalescer // shares upstream lookups between identical misses
+
+	// TCP listener on the same port
+	tcpIdleTimeout    time.Duration
+	tcpMessageTimeout time.Duration // to receive a message once its length arrived
+	tcpMaxConns       int
+
+	cacheFile         string // snapshot path, empty disables persistence
+	cacheSaveInterval time.Duration
+
+	// DNS-over-TLS listener, enabled when a certificate is configured
+	dotPort        int
+	tlsCertFile    string
+	tlsKeyFile     string
+	dotIdleTimeout time.Duration
+	dotMaxConns    int
+
+	// DNS-over-HTTPS listener, 0 disables it
+	dohPort        int
+	dohPlain       bool // plain HTTP behind a TLS-terminating reverse proxy
+	dohIdleTimeout time.Duration
 }
 
 // NewDnsServer creates a new DNS server
 func NewDnsServer(port int) *DnsServer {
-	return &DnsServer{
-		port:     port,
-		cache:    NewDnsCache(),
-		resolver: NewDnsResolver(UpstreamDNS),
+	s := &DnsServer{
+		port:       port,
+		cache:      NewDnsCache(),
+		inflight:   NewCoalescer(),
+		resolver:   NewDnsResolver(defaultUpstreamPool()),
+		maxUDPSize: DefaultEDNSSize,
+
+		staleAnswerTimeout: DefaultStaleAnswerTimeout,
+		failureRecheck:     DefaultFailureRecheck,
+		cacheSaveInterval:  DefaultCacheSaveInterval,
+
+		tcpIdleTimeout:    DefaultTCPIdleTimeout,
+		tcpMessageTimeout: DefaultTCPMessageTimeout,
+		tcpMaxConns:       DefaultTCPMaxConns,
+
+		dotPort:        DefaultDoTListenPort,
+		dotIdleTimeout: DefaultDoTServerIdle,
+		dotMaxConns:    DefaultDoTMaxConns,
+
+		dohIdleTimeout: DefaultDoHServerIdle,
 	}
+	s.cache.prefetch = s.refreshNow
+	return s
+}
+
+func defaultUpstreamPool() *UpstreamPool {
+	up := &Upstream{Addr: UpstreamDNS, Timeout: DefaultUpstreamTimeout, Retries: DefaultUpstreamRetries}
+	return NewUpstreamPool([]*Upstream{up}, PolicyOrdered)
 }
 
 // Start starts UDP and TCP DNS servers
 func (s *DnsServer) Start() error {
+	// The snapshot is loaded before any listener starts, so it can't
+	// overwrite fresher answers cached for early queries
+	log.Printf("💾 Cache initialized")
+	if s.cacheFile != "" {
+		n, err := s.cache.LoadSnapshot(s.cacheFile)
+		if err != nil {
+			log.Printf("❌ Failed to load cache snapshot %s: %v", s.cacheFile, err)
+		} else {
+			log.Printf("💾 Loaded %d cache entries from %s", n, s.cacheFile)
+		}
+		if s.cacheSaveInterval > 0 {
+			go s.saveCachePeriodically()
+		}
+	}
+
 	// -----------------------
 	// UDP SETUP (port 2053)
 	// -----------------------
@@ -54,10 +135,36 @@ func (s *DnsServer) Start() error {
 	// -----------------------
 	// TCP SETUP (port 2053)
 	// -----------------------
-	go s.startTCPServer()
+	if err := s.startTCPServer(); err != nil {
+		return err
+	}
 
-	log.Printf("📡 Upstream DNS: %s", UpstreamDNS)
-	log.Printf("💾 Cache initialized")
+	// -----------------------
+	// DoT SETUP (port 853)
+	// -----------------------
+	if s.tlsCertFile != "" && s.dotPort != 0 {
+		if err := s.startDoTServer(); err != nil {
+			return err
+		}
+	}
+
+	// -----------------------
+	// DoH SETUP (optional)
+	// -----------------------
+	if s.dohPort != 0 {
+		if err := s.startDoHServer(); err != nil {
+			return err
+		}
+	}
+
+	if s.resolver.iterative != nil {
+		log.Printf("📡 Iterative resolution from %d root servers", len(s.resolver.iterative.roots))
+	} else {
+		log.Printf("📡 Upstream DNS: %s", s.resolver.pool)
+	}
+	if s.resolver.forwards != nil {
+		log.Printf("📡 Forwarding: %s", s.resolver.forwards)
+	}
 	log.Println("Ready to handle queries...")
 
 	// Handle UDP requests
@@ -68,7 +175,7 @@ func (s *DnsServer) Start() error {
 // UDP REQUEST HANDLER
 // ---------------------------
 func (s *DnsServer) handleUDPRequests() error {
-	buffer := make([]byte, MaxPacketSize)
+	buffer := make([]byte, s.maxUDPSize)
 
 	for {
 		n, clientAddr, err := s.udpConn.ReadFromUDP(buffer)
@@ -76,108 +183,69 @@ func (s *DnsServer) handleUDPRequests() error {
 			log.Printf("❌ Error reading UDP: %v", err)
 			continue
 		}
-		go s.processDNSQuery(buffer[:n], clientAddr)
+		// buffer is reused by the next read, the handler needs its own copy
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+		go s.processDNSQuery(data, clientAddr)
 	}
 }
 
 // ---------------------------
-// TCP SERVER (NEW)
+// SHARED LOGIC FOR UDP & TCP
 // ---------------------------
-func (s *DnsServer) startTCPServer() {
-	addr := fmt.Sprintf("0.0.0.0:%d", s.port)
-	listener, err := net.Listen("tcp", addr)
+func (s *DnsServer) processDNSQuery(data []byte, clientAddr *net.UDPAddr) {
+	packet, err := FromBytes(data)
 	if err != nil {
-		log.Printf("❌ TCP listen failed: %v", err)
-		return
-	}
-
-	log.Printf("🚀 DNS TCP Server started on 0.0.0.0:%d", s.port)
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("❌ TCP accept error: %v", err)
-			continue
+		log.Printf("❌ Failed to parse UDP request: %v", err)
+		if resp := formErrResponse(data); resp != nil {
+			s.udpConn.WriteToUDP(resp, clientAddr)
 		}
-		go s.handleTCPConnection(conn)
-	}
-}
-
-// ---------------------------
-// TCP CONNECTION HANDLER (NEW)
-// ---------------------------
-func (s *DnsServer) handleTCPConnection(conn net.Conn) {
-	defer conn.Close()
-
-	// First 2 bytes = request length
-	lenBuf := make([]byte, 2)
-	_, err := conn.Read(lenBuf)
-	if err != nil {
-		log.Printf("❌ TCP failed reading length: %v", err)
-		return
-	}
-
-	msgLen := int(lenBuf[0])<<8 | int(lenBuf[1])
-	if msgLen <= 0 {
-		log.Printf("❌ TCP invalid length")
 		return
 	}
 
-	msg := make([]byte, msgLen)
-	_, err = conn.Read(msg)
-	if err != nil {
-		log.Printf("❌ TCP failed reading message: %v", err)
-		return
-	}
+	responsePacket := s.buildResponse(packet, clientAddr.String())
 
-	// Parse request
-	packet, err := FromBytes(msg)
+	responseBytes, err := responsePacket.ToBytesWithSize(s.udpResponseSize(packet))
 	if err != nil {
-		log.Printf("❌ TCP parse failed: %v", err)
+		log.Printf("❌ Failed to encode response: %v", err)
 		return
 	}
 
-	clientAddr := conn.RemoteAddr().String()
-	startTime := time.Now()
-
-	// Process request (same code used for UDP)
-	responsePacket := s.buildResponse(packet, clientAddr)
+	s.udpConn.WriteToUDP(responseBytes, clientAddr)
+}
 
-	// Encode response
-	responseBytes, err := responsePacket.ToBytes()
+// formErrResponse returns a header-only FORMERR answer to a message that
+// couldn't be parsed, or nil when not even a full header arrived or the
+// message is a response itself
+func formErrResponse(msg []byte) []byte {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return nil
+	}
+	p := NewDnsPacket()
+	p.Header.ID = binary.BigEndian.Uint16(msg)
+	p.Header.Response = true
+	p.Header.Opcode = msg[2] >> 3 & 0x0F
+	p.Header.RecursionDesired = msg[2]&0x01 != 0
+	p.Header.RecursionAvailable = true
+	p.Header.RESCODE = FORMERR
+	data, err := p.ToBytes()
 	if err != nil {
-		log.Printf("❌ TCP encode failed: %v", err)
-		return
+		return nil
 	}
-
-	// TCP requires sending length prefix
-	respLen := []byte{byte(len(responseBytes) >> 8), byte(len(responseBytes))}
-	conn.Write(respLen)
-	conn.Write(responseBytes)
-
-	log.Printf("📤 TCP Response sent to %s in %v (size: %d bytes)",
-		clientAddr, time.Since(startTime), len(responseBytes))
+	return data
 }
 
-// ---------------------------
-// SHARED LOGIC FOR UDP & TCP
-// ---------------------------
-func (s *DnsServer) processDNSQuery(data []byte, clientAddr *net.UDPAddr) {
-	packet, err := FromBytes(data)
-	if err != nil {
-		log.Printf("❌ Failed to parse UDP request: %v", err)
-		return
+// udpResponseSize returns the payload size a UDP response to req may use:
+// what the client advertised, capped at our configured maximum
+func (s *DnsServer) udpResponseSize(req *DnsPacket) int {
+	size := req.Edns.payloadSize()
+	if size > s.maxUDPSize {
+		size = s.maxUDPSize
 	}
-
-	responsePacket := s.buildResponse(packet, clientAddr.String())
-
-	responseBytes, err := responsePacket.ToBytes()
-	if err != nil {
-		log.Printf("❌ Failed to encode response: %v", err)
-		return
+	if size < MaxPacketSize {
+		size = MaxPacketSize
 	}
-
-	s.udpConn.WriteToUDP(responseBytes, clientAddr)
+	return size
 }
 
 func (s *DnsServer) buildResponse(requestPacket *DnsPacket, client string) *DnsPacket {
@@ -194,38 +262,174 @@ func (s *DnsServer) buildResponse(requestPacket *DnsPacket, client string) *DnsP
 	// Copy questions
 	responsePacket.Questions = requestPacket.Questions
 
+	// EDNS: answer with our own OPT record if the client sent one
+	dnssecOK := false
+	if requestPacket.Edns != nil {
+		responsePacket.Edns = &Edns{UDPSize: uint16(s.maxUDPSize), DO: requestPacket.Edns.DO}
+		if requestPacket.Edns.Version > EdnsVersion {
+			log.Printf("❌ Unsupported EDNS version %d from %s", requestPacket.Edns.Version, client)
+			responsePacket.Header.RESCODE = BADVERS
+			return responsePacket
+		}
+		dnssecOK = requestPacket.Edns.DO
+	}
+
 	// Process questions
 	for _, q := range requestPacket.Questions {
 		log.Printf("📥 Query from %s: %s [%s]", client, q.Name, q.QType.String())
 
+		// Our own zones are answered from their data, never upstream
+		if zone, ok := s.zones.Lookup(q.Name); ok && (q.QClass == zone.class || q.QClass == QClassANY) {
+			ans := zone.Answer(q.Name, q.QType)
+			log.Printf("📚 Zone %s: %s [%s] %s", fqdn(zone.origin), q.Name, q.QType.String(), ans.rcode)
+			appendSections(responsePacket, ans.answers, ans.authorities, ans.additionals, q.QType, dnssecOK)
+			responsePacket.Header.RESCODE = ans.rcode
+			responsePacket.Header.Authoritative = ans.authoritative
+			continue
+		}
+
 		// Cache hit?
-		if cached, ok := s.cache.Get(q.Name, q.QType); ok {
-			log.Printf("✅ Cache HIT: %s [%s]", q.Name, q.QType.String())
-			responsePacket.Answers = append(responsePacket.Answers, cached)
+		if cached, ok := s.cache.Get(q.Name, q.QType, q.QClass); ok {
+			log.Printf("✅ Cache HIT: %s [%s] %s", q.Name, q.QType.String(), cached.RCode)
+			appendSections(responsePacket, cached.Answers, cached.Authorities, cached.Resources, q.QType, dnssecOK)
+			responsePacket.Header.RESCODE = cached.RCode
 			continue
 		}
 
 		// Cache miss → upstream
 		log.Printf("❌ Cache MISS: %s [%s] - querying upstream", q.Name, q.QType.String())
 
-		upstreamPacket, err := s.resolver.RecursiveLookup(q.Name, q.QType)
+		result, err := s.lookup(q)
 		if err != nil {
 			log.Printf("❌ Upstream error: %v", err)
 			responsePacket.Header.RESCODE = SERVFAIL
 			continue
 		}
 
-		responsePacket.Answers = append(responsePacket.Answers, upstreamPacket.Answers...)
-		responsePacket.Authorities = append(responsePacket.Authorities, upstreamPacket.Authorities...)
-		responsePacket.Resources = append(responsePacket.Resources, upstreamPacket.Resources...)
+		appendSections(responsePacket, result.Answers, result.Authorities, result.Resources, q.QType, dnssecOK)
+		responsePacket.Header.RESCODE = result.RCode
+	}
+
+	log.Printf("⏱️ Processed query in %v", time.Since(startTime))
+	return responsePacket
+}
+
+// lookup resolves q upstream and caches the answer. If upstream fails, or
+// takes longer than staleAnswerTimeout, an expired cache entry still inside
+// the stale window is returned instead (RFC 8767); in the latter case the
+// upstream lookup carries on and refreshes the cache when it completes.
+// After upstream failed for q, stale data is served without asking upstream
+// again until failureRecheck has passed.
+func (s *DnsServer) lookup(q *DnsQuestion) (*CacheItem, error) {
+	if s.recentlyFailed(q) {
+		if stale, ok := s.cache.GetStale(q.Name, q.QType, q.QClass); ok {
+			return stale, nil
+		}
+	}
+
+	type lookupResult struct {
+		item *CacheItem
+		err  error
+	}
+	done := make(chan lookupResult, 1)
+	go func() {
+		upstreamPacket, err := s.resolve(q)
+		if err != nil {
+			done <- lookupResult{err: err}
+			return
+		}
+		done <- lookupResult{item: &CacheItem{
+			Answers:     upstreamPacket.Answers,
+			Authorities: upstreamPacket.Authorities,
+			Resources:   upstreamPacket.Resources,
+			RCode:       upstreamPacket.Header.RESCODE,
+		}}
+	}()
 
-		s.cache.PutMultiple(upstreamPacket.Answers)
+	var timer <-chan time.Time
+	if s.staleAnswerTimeout > 0 {
+		t := time.NewTimer(s.staleAnswerTimeout)
+		defer t.Stop()
+		timer = t.C
+	}
 
+	select {
+	case res := <-done:
+		if res.err == nil {
+			return res.item, nil
+		}
+		if stale, ok := s.cache.GetStale(q.Name, q.QType, q.QClass); ok {
+			log.Printf("🕰️ Serving stale %s [%s] after upstream error: %v", q.Name, q.QType, res.err)
+			return stale, nil
+		}
+		return nil, res.err
+	case <-timer:
+		if stale, ok := s.cache.GetStale(q.Name, q.QType, q.QClass); ok {
+			log.Printf("🕰️ Serving stale %s [%s], upstream slower than %v", q.Name, q.QType, s.staleAnswerTimeout)
+			return stale, nil
+		}
+		res := <-done
+		return res.item, res.err
+	}
+}
+
+// resolve looks q up upstream and caches the answer. Concurrent calls for
+// the same question share a single upstream lookup and cache write.
+func (s *DnsServer) resolve(q *DnsQuestion) (*DnsPacket, error) {
+	key := cacheKey(q.Name, q.QType, q.QClass)
+	resp, shared, err := s.inflight.Do(key, func() (*DnsPacket, error) {
+		upstreamPacket, err := s.resolver.RecursiveLookup(q.Name, q.QType, q.QClass)
+		if err != nil {
+			s.failedAt.Store(key, time.Now())
+			return nil, err
+		}
+		s.failedAt.Delete(key)
+		s.cache.Put(q, upstreamPacket)
 		log.Printf("✅ Upstream resolved: %d answers", len(upstreamPacket.Answers))
+		return upstreamPacket, nil
+	})
+	if shared && err == nil {
+		log.Printf("🔗 Shared in-flight lookup for %s [%s]", q.Name, q.QType)
 	}
+	return resp, err
+}
 
-	log.Printf("⏱️ Processed query in %v", time.Since(startTime))
-	return responsePacket
+// refresh re-resolves q in the background to replace a stale or soon to
+// expire cache entry, unless a refresh for the same question is already
+// running
+func (s *DnsServer) refresh(q *DnsQuestion) {
+	go s.refreshNow(q)
+}
+
+// refreshNow is refresh without the goroutine; it returns once the refresh
+// is done or when another one for q is already running
+func (s *DnsServer) refreshNow(q *DnsQuestion) {
+	if s.recentlyFailed(q) {
+		return
+	}
+	key := cacheKey(q.Name, q.QType, q.QClass)
+	if _, running := s.refreshing.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	defer s.refreshing.Delete(key)
+	if _, err := s.resolve(q); err != nil {
+		log.Printf("❌ Background refresh of %s [%s] failed: %v", q.Name, q.QType, err)
+	}
+}
+
+// recentlyFailed reports whether the last upstream lookup of q failed less
+// than failureRecheck ago
+func (s *DnsServer) recentlyFailed(q *DnsQuestion) bool {
+	at, ok := s.failedAt.Load(cacheKey(q.Name, q.QType, q.QClass))
+	return ok && time.Since(at.(time.Time)) < s.failureRecheck
+}
+
+// appendSections adds answer, authority and additional records to resp,
+// leaving out DNSSEC records the client didn't ask for
+func appendSections(resp *DnsPacket, answers, authorities, resources []*DnsRecord, qtype QType, dnssecOK bool) {
+	resp.Answers = append(resp.Answers, filterDNSSEC(answers, qtype, dnssecOK)...)
+	resp.Authorities = append(resp.Authorities, filterDNSSEC(authorities, qtype, dnssecOK)...)
+	resp.Resources = append(resp.Resources, filterDNSSEC(resources, qtype, dnssecOK)...)
 }
 
 func (s *DnsServer) Stop() {
@@ -233,14 +437,206 @@ func (s *DnsServer) Stop() {
 		log.Println("🛑 Shutting down DNS server...")
 		s.udpConn.Close()
 	}
+	s.cache.Close()
+	s.resolver.pool.Close()
+	if s.resolver.forwards != nil {
+		for _, pool := range s.resolver.forwards.Pools() {
+			pool.Close()
+		}
+	}
+	s.saveCache()
+}
+
+// saveCache writes a cache snapshot if persistence is enabled
+func (s *DnsServer) saveCache() {
+	if s.cacheFile == "" {
+		return
+	}
+	n, err := s.cache.SaveSnapshot(s.cacheFile)
+	if err != nil {
+		log.Printf("❌ Failed to save cache snapshot %s: %v", s.cacheFile, err)
+		return
+	}
+	log.Printf("💾 Saved %d cache entries to %s", n, s.cacheFile)
+}
+
+func (s *DnsServer) saveCachePeriodically() {
+	ticker := time.NewTicker(s.cacheSaveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.saveCache()
+	}
 }
 
 func (s *DnsServer) PrintStats() {
 	log.Printf("📊 Cache Stats: %s", s.cache.Stats())
+	log.Printf("📊 Lookup Stats: %s", s.inflight.Stats())
+}
+
+// stringList is a flag that may be repeated or given comma-separated values
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// repeatedFlag collects every occurrence of a flag verbatim
+type repeatedFlag []string
+
+func (l *repeatedFlag) String() string { return strings.Join(*l, " ") }
+
+func (l *repeatedFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
 }
 
 func main() {
-	server := NewDnsServer(DefaultPort)
+	port := flag.Int("port", DefaultPort, "UDP/TCP port to listen on")
+	var upstreams stringList
+	flag.Var(&upstreams, "upstream", "upstream resolver as [tls:// or https://]host[:port][/path][?timeout=2s&retries=1], repeatable (default "+UpstreamDNS+")")
+	upstreamPolicy := flag.String("upstream-policy", "ordered", "upstream selection: ordered, round-robin, random or lowest-latency")
+	upstreamTimeout := flag.Duration("upstream-timeout", DefaultUpstreamTimeout, "default per-attempt upstream timeout")
+	upstreamRetries := flag.Int("upstream-retries", DefaultUpstreamRetries, "default extra attempts per upstream before failing over")
+	upstreamMaxFails := flag.Int("upstream-max-fails", DefaultUpstreamMaxFails, "consecutive failures before an upstream is marked down (0 = never)")
+	var forwards repeatedFlag
+	flag.Var(&forwards, "forward", "forward a domain suffix to its own upstreams as suffix=upstream[,upstream...], repeatable")
+	var zones repeatedFlag
+	flag.Var(&zones, "zone", "serve a zone authoritatively from an RFC 1035 master file as origin=path, repeatable")
+	recursive := flag.Bool("recursive", false, "resolve iteratively from the root servers instead of forwarding to -upstream")
+	var rootHints stringList
+	flag.Var(&rootHints, "root-hints", "root server addresses as host[:port] for -recursive, repeatable (default the IANA root servers)")
+	nameserverPort := flag.Int("nameserver-port", 53, "port used with -recursive for nameservers learned from referrals")
+	use0x20 := flag.Bool("dns0x20", false, "randomize the case of upstream query names and require it echoed back (DNS 0x20)")
+	maxCoalescedWaiters := flag.Int("max-coalesced-waiters", DefaultMaxCoalescedWaiters, "clients that may wait on one in-flight upstream lookup before the rest get a stale answer or SERVFAIL (0 = unlimited)")
+	healthCheckInterval := flag.Duration("health-check-interval", DefaultHealthCheckInterval, "how often upstreams marked down are probed (0 = never)")
+	maxUDPSize := flag.Int("max-udp-size", DefaultEDNSSize, "largest EDNS UDP payload size served to clients")
+	maxNegativeTTL := flag.Duration("max-negative-ttl", DefaultMaxNegativeTTL, "upper bound on how long NXDOMAIN/NODATA answers are cached")
+	cacheMaxEntries := flag.Int("cache-max-entries", DefaultCacheMaxEntries, "maximum number of cached questions (0 = unlimited)")
+	cacheMaxBytes := flag.Int("cache-max-bytes", 0, "approximate cache memory budget in bytes (0 = unlimited)")
+	sweepInterval := flag.Duration("cache-sweep-interval", DefaultCacheSweepInterval, "how often expired cache entries are removed (0 = never)")
+	cacheFile := flag.String("cache-file", "", "persist the cache to this file across restarts")
+	cacheSaveInterval := flag.Duration("cache-save-interval", DefaultCacheSaveInterval, "how often the cache snapshot is written (0 = only on shutdown)")
+	staleWindow := flag.Duration("serve-stale", DefaultStaleWindow, "how long expired answers may still be served when upstream fails (0 = disabled)")
+	prefetchHits := flag.Uint("prefetch-hits", DefaultPrefetchHits, "recent hits after which an entry is refreshed before it expires (0 = disabled)")
+	prefetchPercent := flag.Int("prefetch-percent", DefaultPrefetchPercent, "refresh popular entries within this last percentage of their TTL")
+	staleAnswerTimeout := flag.Duration("stale-answer-timeout", DefaultStaleAnswerTimeout, "serve a stale answer if upstream hasn't replied within this time (0 = only on failure)")
+	failureRecheck := flag.Duration("stale-failure-recheck", DefaultFailureRecheck, "after upstream fails for a name, serve it stale without asking upstream for this long")
+	tcpIdleTimeout := flag.Duration("tcp-idle-timeout", DefaultTCPIdleTimeout, "close TCP connections idle for this long (advertised via edns-tcp-keepalive)")
+	tcpMessageTimeout := flag.Duration("tcp-message-timeout", DefaultTCPMessageTimeout, "time allowed to receive a TCP/DoT message once its length prefix arrived")
+	tcpMaxConns := flag.Int("tcp-max-conns", DefaultTCPMaxConns, "maximum concurrent TCP connections")
+	dotPort := flag.Int("dot-port", DefaultDoTListenPort, "DNS-over-TLS port, served when -tls-cert and -tls-key are set (0 = disabled)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate for the DNS-over-TLS listener, reloaded when the file changes")
+	tlsKey := flag.String("tls-key", "", "PEM private key for -tls-cert")
+	dotIdleTimeout := flag.Duration("dot-idle-timeout", DefaultDoTServerIdle, "close DNS-over-TLS connections idle for this long")
+	dotMaxConns := flag.Int("dot-max-conns", DefaultDoTMaxConns, "maximum concurrent DNS-over-TLS connections")
+	dohPort := flag.Int("doh-port", 0, fmt.Sprintf("DNS-over-HTTPS port serving /dns-query and /resolve, usually %d (0 = disabled)", DefaultDoHListenPort))
+	dohPlain := flag.Bool("doh-plain", false, "serve DNS-over-HTTPS as plain HTTP, for use behind a TLS-terminating reverse proxy")
+	dohIdleTimeout := flag.Duration("doh-idle-timeout", DefaultDoHServerIdle, "close idle DNS-over-HTTPS keep-alive connections after this long")
+	flag.Parse()
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("❌ -tls-cert and -tls-key must be given together")
+	}
+	if *dohPort != 0 && !*dohPlain && *tlsCert == "" {
+		log.Fatalf("❌ -doh-port needs -tls-cert and -tls-key, or -doh-plain")
+	}
+
+	if len(upstreams) == 0 {
+		upstreams = stringList{UpstreamDNS}
+	}
+	policy, err := ParseUpstreamPolicy(*upstreamPolicy)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	var ups []*Upstream
+	for _, spec := range upstreams {
+		u, err := ParseUpstream(spec, *upstreamTimeout, *upstreamRetries)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		ups = append(ups, u)
+	}
+	pool := NewUpstreamPool(ups, policy)
+	pool.maxFails = *upstreamMaxFails
+	pool.StartHealthChecks(*healthCheckInterval)
+
+	server := NewDnsServer(*port)
+	server.resolver = NewDnsResolver(pool)
+	if len(forwards) > 0 {
+		server.resolver.forwards = NewForwardTable()
+		for _, spec := range forwards {
+			suffix, fwdPool, err := ParseForward(spec, policy, *upstreamTimeout, *upstreamRetries)
+			if err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+			fwdPool.maxFails = *upstreamMaxFails
+			fwdPool.StartHealthChecks(*healthCheckInterval)
+			server.resolver.forwards.Add(suffix, fwdPool)
+		}
+	}
+	server.resolver.use0x20 = *use0x20
+	if len(zones) > 0 {
+		server.zones = NewZoneTable()
+		for _, spec := range zones {
+			origin, path, err := ParseZoneSpec(spec)
+			if err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+			zone, err := LoadZone(origin, path)
+			if err != nil {
+				log.Fatalf("❌ Loading zone %s: %v", origin, err)
+			}
+			server.zones.Add(zone)
+			log.Printf("📚 Loaded zone %s from %s", zone, path)
+		}
+	}
+	if *recursive {
+		roots := RootHints
+		if len(rootHints) > 0 {
+			roots = nil
+			for _, h := range rootHints {
+				if _, _, err := net.SplitHostPort(h); err != nil {
+					h = net.JoinHostPort(strings.Trim(h, "[]"), "53")
+				}
+				roots = append(roots, h)
+			}
+		}
+		server.resolver.iterative = NewIterativeResolver(roots)
+		server.resolver.iterative.port = strconv.Itoa(*nameserverPort)
+		server.resolver.iterative.timeout = *upstreamTimeout
+		server.resolver.iterative.use0x20 = *use0x20
+	}
+	server.maxUDPSize = *maxUDPSize
+	server.tcpIdleTimeout = *tcpIdleTimeout
+	server.tcpMessageTimeout = *tcpMessageTimeout
+	server.tcpMaxConns = *tcpMaxConns
+	server.dotPort = *dotPort
+	server.tlsCertFile = *tlsCert
+	server.tlsKeyFile = *tlsKey
+	server.dotIdleTimeout = *dotIdleTimeout
+	server.dotMaxConns = *dotMaxConns
+	server.dohPort = *dohPort
+	server.dohPlain = *dohPlain
+	server.dohIdleTimeout = *dohIdleTimeout
+	server.inflight.maxWaiters = *maxCoalescedWaiters
+	server.cache.maxNegativeTTL = *maxNegativeTTL
+	server.cache.maxEntries = *cacheMaxEntries
+	server.cache.maxBytes = *cacheMaxBytes
+	server.cache.staleWindow = *staleWindow
+	server.cacheFile = *cacheFile
+	server.cacheSaveInterval = *cacheSaveInterval
+	server.staleAnswerTimeout = *staleAnswerTimeout
+	server.failureRecheck = *failureRecheck
+	server.cache.prefetchHits = uint32(*prefetchHits)
+	server.cache.prefetchPercent = *prefetchPercent
+	server.cache.StartSweeper(*sweepInterval)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
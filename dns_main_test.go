@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server, not yet listening, that forwards to a
+// fake upstream answering with handle
+func newTestServer(t *testing.T, handle func(q *DnsPacket) *DnsPacket) (*DnsServer, *fakeServer) {
+	t.Helper()
+	upstream := startFakeServer(t, "127.0.0.1:0", handle)
+	s := NewDnsServer(0)
+	s.resolver = NewDnsResolver(NewUpstreamPool([]*Upstream{{Addr: upstream.addr, Timeout: time.Second}}, PolicyOrdered))
+	return s, upstream
+}
+
+func TestStaleServedWithoutRecheckAfterFailure(t *testing.T) {
+	s, upstream := newTestServer(t, func(q *DnsPacket) *DnsPacket {
+		return reply(q, SERVFAIL)
+	})
+	s.staleAnswerTimeout = 0
+	q := &DnsQuestion{Name: "example.com", QType: QTypeA, QClass: QClassIN}
+	s.cache.store(q, &CacheItem{RCode: NOERROR, Expiry: time.Now().Add(-time.Second)}, time.Minute)
+
+	for range 3 {
+		if _, err := s.lookup(q); err != nil {
+			t.Fatalf("lookup: %v, want the stale answer", err)
+		}
+	}
+	// give a background refresh, if one was started, time to reach upstream
+	time.Sleep(50 * time.Millisecond)
+	if n := upstream.queries.Load(); n != 1 {
+		t.Fatalf("upstream asked %d times, want 1 until the failure recheck passes", n)
+	}
+
+	s.failureRecheck = 0
+	if _, err := s.lookup(q); err != nil {
+		t.Fatal(err)
+	}
+	if n := upstream.queries.Load(); n != 2 {
+		t.Fatalf("upstream asked %d times after the recheck passed, want 2", n)
+	}
+}
+
+func TestUDPFormErrOnUnparsableQuery(t *testing.T) {
+	s := NewDnsServer(0)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s.udpConn = conn
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	from := client.LocalAddr().(*net.UDPAddr)
+
+	s.processDNSQuery([]byte{1, 2, 3}, from)
+	s.processDNSQuery([]byte{0xBE, 0xEF, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}, from)
+	buf := make([]byte, 512)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := FromBytes(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the short message got no answer, so this is the reply to the header
+	if resp.Header.ID != 0xBEEF || resp.Header.RESCODE != FORMERR || !resp.Header.RecursionDesired {
+		t.Fatalf("got ID %#x rcode %s, want FORMERR for ID 0xbeef", resp.Header.ID, resp.Header.RESCODE)
+	}
+}
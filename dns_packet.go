@@ -1,20 +1,26 @@
 package main
 
+import (
+	"errors"
+	"strings"
+)
+
 type DnsPacket struct {
-	Header     *DnsHeader
-	Questions  []*DnsQuestion
-	Answers    []*DnsRecord
+	Header      *DnsHeader
+	Questions   []*DnsQuestion
+	Answers     []*DnsRecord
 	Authorities []*DnsRecord
-	Resources  []*DnsRecord
+	Resources   []*DnsRecord
+	Edns        *Edns // OPT pseudo-record, nil when absent
 }
 
 func NewDnsPacket() *DnsPacket {
 	return &DnsPacket{
-		Header: NewDnsHeader(),
-		Questions: make([]*DnsQuestion, 0),
-		Answers: make([]*DnsRecord, 0),
+		Header:      NewDnsHeader(),
+		Questions:   make([]*DnsQuestion, 0),
+		Answers:     make([]*DnsRecord, 0),
 		Authorities: make([]*DnsRecord, 0),
-		Resources: make([]*DnsRecord, 0),
+		Resources:   make([]*DnsRecord, 0),
 	}
 }
 
@@ -57,40 +63,166 @@ func FromBytes(data []byte) (*DnsPacket, error) {
 		if err != nil {
 			return nil, err
 		}
+		if r.Type == QTypeOPT {
+			if p.Edns != nil {
+				return nil, errors.New("multiple OPT records")
+			}
+			if p.Edns, err = ednsFromRecord(r); err != nil {
+				return nil, err
+			}
+			// the header only carries the lower 4 bits of the RCODE
+			p.Header.RESCODE = RCode(uint16(p.Edns.ExtRCode)<<4 | uint16(p.Header.RESCODE&0x0F))
+			continue
+		}
 		p.Resources = append(p.Resources, r)
 	}
 	return p, nil
 }
 
+// ToBytes serializes the packet with name compression
 func (p *DnsPacket) ToBytes() ([]byte, error) {
-	buf := NewPacketBuffer()
+	return p.ToBytesWithSize(MaxPacketSize)
+}
+
+// ToBytesWithSize serializes the packet into at most size bytes, e.g. the
+// payload size negotiated through EDNS. Whole RRsets that don't fit are
+// left out; if any of them belong to the answer or authority section the
+// TC bit is set (RFC 2181 9). The OPT record is always kept.
+func (p *DnsPacket) ToBytesWithSize(size int) ([]byte, error) {
+	var opt *DnsRecord
+	optLen := 0
+	if p.Edns != nil {
+		p.Edns.ExtRCode = uint8(p.Header.RESCODE >> 4)
+		opt = p.Edns.record()
+		// root name, type, class, ttl, rdlength and the options
+		optLen = 11 + len(opt.RData.(*RDataOpaque).Data)
+	}
+	if size < 12+optLen {
+		return nil, errBufferOverflow
+	}
+	buf := NewPacketBufferWithSize(size)
+	buf.buf = buf.buf[:size-optLen]
+
+	header := *p.Header
+	if err := header.Write(buf); err != nil {
+		return nil, err
+	}
+	for _, q := range p.Questions {
+		if err := q.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+	header.QDCount = uint16(len(p.Questions))
+
+	an, truncated, err := writeRRsets(buf, p.Answers)
+	if err != nil {
+		return nil, err
+	}
+	header.ANCount = uint16(an)
+	header.NSCount, header.ARCount = 0, 0
+	if !truncated {
+		var ns int
+		ns, truncated, err = writeRRsets(buf, p.Authorities)
+		if err != nil {
+			return nil, err
+		}
+		header.NSCount = uint16(ns)
+	}
+	if !truncated {
+		// missing additional data doesn't warrant TC
+		ar, _, err := writeRRsets(buf, p.Resources)
+		if err != nil {
+			return nil, err
+		}
+		header.ARCount = uint16(ar)
+	}
+	if truncated {
+		header.Truncated = true
+	}
+
+	buf.buf = buf.buf[:size]
+	if opt != nil {
+		if err := opt.Write(buf); err != nil {
+			return nil, err
+		}
+		header.ARCount++
+	}
+
+	end := buf.Current()
+	buf.pos = 0
+	if err := header.Write(buf); err != nil {
+		return nil, err
+	}
+	buf.pos = end
+	return buf.Bytes(), nil
+}
+
+// writeRRsets writes records one RRset at a time, stopping at the first
+// RRset that doesn't fit. It returns the number of records written and
+// whether any were left out.
+func writeRRsets(buf *BytePacketBuffer, records []*DnsRecord) (int, bool, error) {
+	written := 0
+	for written < len(records) {
+		end := written + 1
+		for end < len(records) && sameRRset(records[written], records[end]) {
+			end++
+		}
+		mark := buf.Current()
+		for _, r := range records[written:end] {
+			if err := r.Write(buf); err != nil {
+				if errors.Is(err, errBufferOverflow) {
+					buf.truncate(mark)
+					return written, true, nil
+				}
+				return 0, false, err
+			}
+		}
+		written = end
+	}
+	return written, false, nil
+}
+
+func sameRRset(a, b *DnsRecord) bool {
+	return a.Type == b.Type && a.Class == b.Class && strings.EqualFold(a.Name, b.Name)
+}
+
+func (p *DnsPacket) Write(buf *BytePacketBuffer) error {
 	p.Header.QDCount = uint16(len(p.Questions))
 	p.Header.ANCount = uint16(len(p.Answers))
 	p.Header.NSCount = uint16(len(p.Authorities))
 	p.Header.ARCount = uint16(len(p.Resources))
+	if p.Edns != nil {
+		p.Header.ARCount++
+		p.Edns.ExtRCode = uint8(p.Header.RESCODE >> 4)
+	}
 
 	if err := p.Header.Write(buf); err != nil {
-		return nil, err
+		return err
 	}
 	for _, q := range p.Questions {
 		if err := q.Write(buf); err != nil {
-			return nil, err
+			return err
 		}
 	}
 	for _, a := range p.Answers {
 		if err := a.Write(buf); err != nil {
-			return nil, err
+			return err
 		}
 	}
 	for _, a := range p.Authorities {
 		if err := a.Write(buf); err != nil {
-			return nil, err
+			return err
 		}
 	}
 	for _, a := range p.Resources {
 		if err := a.Write(buf); err != nil {
-			return nil, err
+			return err
 		}
 	}
-	return buf.Bytes(), nil
+	if p.Edns != nil {
+		if err := p.Edns.record().Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
 }
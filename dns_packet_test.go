@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func compressionTestPacket() *DnsPacket {
+	p := NewDnsPacket()
+	p.Header.Response = true
+	p.Questions = append(p.Questions, &DnsQuestion{Name: "www.Example.com", QType: QTypeMX, QClass: QClassIN})
+	p.Answers = append(p.Answers,
+		&DnsRecord{Name: "www.example.COM", Type: QTypeCNAME, Class: QClassIN, TTL: 60, RData: &RDataCNAME{Target: "mail.EXAMPLE.com"}},
+		&DnsRecord{Name: "mail.example.com", Type: QTypeMX, Class: QClassIN, TTL: 60, RData: &RDataMX{Preference: 10, Exchange: "mx1.example.com"}},
+		&DnsRecord{Name: "mail.example.com", Type: QTypeMX, Class: QClassIN, TTL: 60, RData: &RDataMX{Preference: 20, Exchange: "mx2.example.org"}},
+	)
+	return p
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	compressed, err := compressionTestPacket().ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := NewPacketBufferWithSize(MaxPacketSize)
+	buf.SetCompression(false)
+	if err := compressionTestPacket().Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= buf.Len() {
+		t.Fatalf("compressed message is %d bytes, uncompressed %d", len(compressed), buf.Len())
+	}
+
+	got, err := FromBytes(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := compressionTestPacket()
+	if !strings.EqualFold(got.Questions[0].Name, want.Questions[0].Name) {
+		t.Errorf("question %q, want %q", got.Questions[0].Name, want.Questions[0].Name)
+	}
+	if len(got.Answers) != len(want.Answers) {
+		t.Fatalf("got %d answers, want %d", len(got.Answers), len(want.Answers))
+	}
+	for i, rec := range got.Answers {
+		// names compare case-insensitively; compression may reuse a suffix
+		// written in a different case
+		if !strings.EqualFold(rec.String(), want.Answers[i].String()) {
+			t.Errorf("answer %d: got %s, want %s", i, rec, want.Answers[i])
+		}
+	}
+}
+
+func TestExtendedRCodeRoundTrip(t *testing.T) {
+	for _, rc := range []RCode{NXDOMAIN, BADVERS, BADCOOKIE, RCode(0xF03)} {
+		p := NewDnsPacket()
+		p.Header.Response = true
+		p.Header.RESCODE = rc
+		p.Edns = &Edns{UDPSize: 1232}
+		data, err := p.ToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := FromBytes(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Header.RESCODE != rc {
+			t.Errorf("got rcode %d, want %d", got.Header.RESCODE, rc)
+		}
+	}
+	if rc, err := ParseRCode("RCODE3000"); err != nil || rc != 3000 {
+		t.Errorf("ParseRCode(RCODE3000) = %d, %v", rc, err)
+	}
+}
+
+func TestTruncationDropsWholeRRsets(t *testing.T) {
+	p := NewDnsPacket()
+	p.Header.Response = true
+	p.Questions = append(p.Questions, &DnsQuestion{Name: "example.com", QType: QTypeANY, QClass: QClassIN})
+	for i := range 10 {
+		p.Answers = append(p.Answers, &DnsRecord{Name: "a.example.com", Type: QTypeA, Class: QClassIN, TTL: 60, RData: &RDataA{IP: []byte{192, 0, 2, byte(i)}}})
+	}
+	for i := range 30 {
+		p.Answers = append(p.Answers, &DnsRecord{Name: "b.example.com", Type: QTypeA, Class: QClassIN, TTL: 60, RData: &RDataA{IP: []byte{198, 51, 100, byte(i)}}})
+	}
+	p.Edns = &Edns{UDPSize: 1232, DO: true}
+
+	data, err := p.ToBytesWithSize(MaxPacketSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > MaxPacketSize {
+		t.Fatalf("message is %d bytes, limit %d", len(data), MaxPacketSize)
+	}
+	got, err := FromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Header.Truncated {
+		t.Error("TC not set")
+	}
+	if len(got.Answers) != 10 {
+		t.Errorf("got %d answers, want only the first RRset of 10", len(got.Answers))
+	}
+	if got.Edns == nil || !got.Edns.DO {
+		t.Error("OPT record dropped")
+	}
+
+	// everything fits in a larger payload
+	data, err = p.ToBytesWithSize(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err = FromBytes(data); err != nil || got.Header.Truncated || len(got.Answers) != 40 {
+		t.Errorf("4096-byte payload: truncated %v with %d answers (%v)", got.Header.Truncated, len(got.Answers), err)
+	}
+}
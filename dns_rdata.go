@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RData is the type-specific payload of a resource record
+type RData interface {
+	// Write encodes the RDATA into buf, without the RDLENGTH prefix
+	Write(buf *BytePacketBuffer) error
+	// String returns the RDATA in master file presentation format
+	String() string
+}
+
+type RDataA struct {
+	IP net.IP
+}
+
+type RDataAAAA struct {
+	IP net.IP
+}
+
+type RDataNS struct {
+	Host string
+}
+
+type RDataCNAME struct {
+	Target string
+}
+
+type RDataPTR struct {
+	Host string
+}
+
+type RDataMX struct {
+	Preference uint16
+	Exchange   string
+}
+
+type RDataSOA struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+// RDataTXT holds one or more character-strings (RFC 1035 3.3.14)
+type RDataTXT struct {
+	Strings []string
+}
+
+type RDataSRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// RDataCAA is a certification authority authorization (RFC 8659)
+type RDataCAA struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+// RDataOpaque carries RDATA of a type we don't interpret (RFC 3597)
+type RDataOpaque struct {
+	Data []byte
+}
+
+// readRData decodes rdlen bytes of RDATA for qtype. Names are expanded, so
+// the result never refers back into buf.
+func readRData(buf *BytePacketBuffer, qtype QType, rdlen int) (RData, error) {
+	start := buf.pos
+	end := start + rdlen
+	if end > len(buf.buf) {
+		return nil, errors.New("rdata too long")
+	}
+	// Only OPT and types we don't interpret may carry empty RDATA
+	if rdlen == 0 {
+		switch qtype {
+		case QTypeA, QTypeAAAA, QTypeNS, QTypeCNAME, QTypePTR, QTypeMX,
+			QTypeSOA, QTypeTXT, QTypeSRV, QTypeCAA:
+			return nil, fmt.Errorf("empty %s rdata", qtype)
+		}
+	}
+
+	var rd RData
+	var err error
+	switch qtype {
+	case QTypeA:
+		if rdlen != 4 {
+			return nil, errors.New("bad A rdata length")
+		}
+		ip := make(net.IP, 4)
+		copy(ip, buf.buf[start:end])
+		buf.pos = end
+		rd = &RDataA{IP: ip}
+	case QTypeAAAA:
+		if rdlen != 16 {
+			return nil, errors.New("bad AAAA rdata length")
+		}
+		ip := make(net.IP, 16)
+		copy(ip, buf.buf[start:end])
+		buf.pos = end
+		rd = &RDataAAAA{IP: ip}
+	case QTypeNS:
+		var host string
+		host, err = buf.ReadQName()
+		rd = &RDataNS{Host: host}
+	case QTypeCNAME:
+		var target string
+		target, err = buf.ReadQName()
+		rd = &RDataCNAME{Target: target}
+	case QTypePTR:
+		var host string
+		host, err = buf.ReadQName()
+		rd = &RDataPTR{Host: host}
+	case QTypeMX:
+		mx := &RDataMX{}
+		if mx.Preference, err = buf.ReadUint16(); err == nil {
+			mx.Exchange, err = buf.ReadQName()
+		}
+		rd = mx
+	case QTypeSOA:
+		rd, err = readSOA(buf)
+	case QTypeTXT:
+		txt := &RDataTXT{}
+		for buf.pos < end && err == nil {
+			var s string
+			s, err = readCharString(buf, end)
+			txt.Strings = append(txt.Strings, s)
+		}
+		rd = txt
+	case QTypeSRV:
+		srv := &RDataSRV{}
+		if srv.Priority, err = buf.ReadUint16(); err != nil {
+			return nil, err
+		}
+		if srv.Weight, err = buf.ReadUint16(); err != nil {
+			return nil, err
+		}
+		if srv.Port, err = buf.ReadUint16(); err != nil {
+			return nil, err
+		}
+		srv.Target, err = buf.ReadQName()
+		rd = srv
+	case QTypeCAA:
+		caa := &RDataCAA{}
+		if caa.Flags, err = buf.Read(); err != nil {
+			return nil, err
+		}
+		if caa.Tag, err = readCharString(buf, end); err != nil {
+			return nil, err
+		}
+		caa.Value = string(buf.buf[buf.pos:end])
+		buf.pos = end
+		rd = caa
+	default:
+		data := make([]byte, rdlen)
+		copy(data, buf.buf[start:end])
+		buf.pos = end
+		rd = &RDataOpaque{Data: data}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if buf.pos != end {
+		return nil, errors.New("rdata length mismatch")
+	}
+	return rd, nil
+}
+
+func readSOA(buf *BytePacketBuffer) (*RDataSOA, error) {
+	soa := &RDataSOA{}
+	var err error
+	if soa.MName, err = buf.ReadQName(); err != nil {
+		return nil, err
+	}
+	if soa.RName, err = buf.ReadQName(); err != nil {
+		return nil, err
+	}
+	for _, f := range []*uint32{&soa.Serial, &soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum} {
+		if *f, err = buf.ReadUint32(); err != nil {
+			return nil, err
+		}
+	}
+	return soa, nil
+}
+
+// readCharString reads a length-prefixed character-string that must end
+// before end
+func readCharString(buf *BytePacketBuffer, end int) (string, error) {
+	l, err := buf.Read()
+	if err != nil {
+		return "", err
+	}
+	if buf.pos+int(l) > end {
+		return "", errors.New("character-string overflows rdata")
+	}
+	s := string(buf.buf[buf.pos : buf.pos+int(l)])
+	buf.pos += int(l)
+	return s, nil
+}
+
+func writeCharString(buf *BytePacketBuffer, s string) error {
+	if len(s) > 255 {
+		return errors.New("character-string too long")
+	}
+	if err := buf.Write([]byte{byte(len(s))}); err != nil {
+		return err
+	}
+	return buf.Write([]byte(s))
+}
+
+// writeNameVerbatim writes a name without compression, for types defined
+// after RFC 1035 which must not be compressed (RFC 3597 4)
+func writeNameVerbatim(buf *BytePacketBuffer, name string) error {
+	compress := buf.compress
+	buf.compress = false
+	err := buf.WriteQName(name)
+	buf.compress = compress
+	return err
+}
+
+func (d *RDataA) Write(buf *BytePacketBuffer) error {
+	ip := d.IP.To4()
+	if ip == nil {
+		return errors.New("not ipv4")
+	}
+	return buf.Write(ip)
+}
+
+func (d *RDataA) String() string { return d.IP.String() }
+
+func (d *RDataAAAA) Write(buf *BytePacketBuffer) error {
+	ip := d.IP.To16()
+	if ip == nil {
+		return errors.New("not ipv6")
+	}
+	return buf.Write(ip)
+}
+
+func (d *RDataAAAA) String() string { return d.IP.String() }
+
+func (d *RDataNS) Write(buf *BytePacketBuffer) error { return buf.WriteQName(d.Host) }
+func (d *RDataNS) String() string                    { return fqdn(d.Host) }
+
+func (d *RDataCNAME) Write(buf *BytePacketBuffer) error { return buf.WriteQName(d.Target) }
+func (d *RDataCNAME) String() string                    { return fqdn(d.Target) }
+
+func (d *RDataPTR) Write(buf *BytePacketBuffer) error { return buf.WriteQName(d.Host) }
+func (d *RDataPTR) String() string                    { return fqdn(d.Host) }
+
+func (d *RDataMX) Write(buf *BytePacketBuffer) error {
+	if err := buf.WriteUint16(d.Preference); err != nil {
+		return err
+	}
+	return buf.WriteQName(d.Exchange)
+}
+
+func (d *RDataMX) String() string {
+	return fmt.Sprintf("%d %s", d.Preference, fqdn(d.Exchange))
+}
+
+func (d *RDataSOA) Write(buf *BytePacketBuffer) error {
+	if err := buf.WriteQName(d.MName); err != nil {
+		return err
+	}
+	if err := buf.WriteQName(d.RName); err != nil {
+		return err
+	}
+	for _, v := range []uint32{d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum} {
+		if err := buf.WriteUint32(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *RDataSOA) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(d.MName), fqdn(d.RName),
+		d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum)
+}
+
+func (d *RDataTXT) Write(buf *BytePacketBuffer) error {
+	for _, s := range d.Strings {
+		if err := writeCharString(buf, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *RDataTXT) String() string {
+	parts := make([]string, len(d.Strings))
+	for i, s := range d.Strings {
+		parts[i] = quoteCharString(s)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (d *RDataSRV) Write(buf *BytePacketBuffer) error {
+	for _, v := range []uint16{d.Priority, d.Weight, d.Port} {
+		if err := buf.WriteUint16(v); err != nil {
+			return err
+		}
+	}
+	return writeNameVerbatim(buf, d.Target)
+}
+
+func (d *RDataSRV) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.Priority, d.Weight, d.Port, fqdn(d.Target))
+}
+
+func (d *RDataCAA) Write(buf *BytePacketBuffer) error {
+	if err := buf.Write([]byte{d.Flags}); err != nil {
+		return err
+	}
+	if err := writeCharString(buf, d.Tag); err != nil {
+		return err
+	}
+	return buf.Write([]byte(d.Value))
+}
+
+func (d *RDataCAA) String() string {
+	return fmt.Sprintf("%d %s %s", d.Flags, d.Tag, quoteCharString(d.Value))
+}
+
+func (d *RDataOpaque) Write(buf *BytePacketBuffer) error { return buf.Write(d.Data) }
+
+// String uses the generic \# syntax from RFC 3597 5
+func (d *RDataOpaque) String() string {
+	if len(d.Data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, len(d.Data), hex.EncodeToString(d.Data))
+}
+
+// fqdn returns name with a trailing dot, as used in presentation format
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// quoteCharString quotes a character-string, escaping quotes, backslashes
+// and non-printable bytes as \DDD
+func quoteCharString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c > 0x7E:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRDataRoundTrip(t *testing.T) {
+	tests := []struct {
+		qtype QType
+		rdata RData
+		want  string
+	}{
+		{QTypeA, &RDataA{IP: net.ParseIP("192.0.2.1")}, "192.0.2.1"},
+		{QTypeAAAA, &RDataAAAA{IP: net.ParseIP("2001:db8::1")}, "2001:db8::1"},
+		{QTypeNS, &RDataNS{Host: "ns1.example.com"}, "ns1.example.com."},
+		{QTypePTR, &RDataPTR{Host: "host.example.com"}, "host.example.com."},
+		{QTypeMX, &RDataMX{Preference: 10, Exchange: "mail.example.com"}, "10 mail.example.com."},
+		{QTypeSOA, &RDataSOA{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300},
+			"ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300"},
+		{QTypeTXT, &RDataTXT{Strings: []string{"v=spf1 -all", `say "hi"`, "\x01"}}, `"v=spf1 -all" "say \"hi\"" "\001"`},
+		{QTypeSRV, &RDataSRV{Priority: 1, Weight: 5, Port: 5060, Target: "sip.example.com"}, "1 5 5060 sip.example.com."},
+		{QTypeCAA, &RDataCAA{Flags: 128, Tag: "issue", Value: "ca.example.net"}, `128 issue "ca.example.net"`},
+		{QType(65280), &RDataOpaque{Data: []byte{0xde, 0xad, 0xbe, 0xef}}, `\# 4 deadbeef`},
+		{QType(65280), &RDataOpaque{Data: []byte{}}, `\# 0`},
+	}
+	for _, tt := range tests {
+		p := NewDnsPacket()
+		p.Answers = append(p.Answers, &DnsRecord{Name: "example.com", Type: tt.qtype, Class: QClassIN, TTL: 300, RData: tt.rdata})
+		data, err := p.ToBytes()
+		if err != nil {
+			t.Errorf("%s: write: %v", tt.qtype, err)
+			continue
+		}
+		got, err := FromBytes(data)
+		if err != nil {
+			t.Errorf("%s: read: %v", tt.qtype, err)
+			continue
+		}
+		if s := got.Answers[0].RData.String(); s != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.qtype, s, tt.want)
+		}
+	}
+}
+
+func TestEmptyRDataRejected(t *testing.T) {
+	for _, qtype := range []QType{QTypeA, QTypeAAAA, QTypeNS, QTypeCNAME, QTypePTR, QTypeMX, QTypeSOA, QTypeTXT, QTypeSRV, QTypeCAA} {
+		buf := NewPacketBufferWithSize(16)
+		if _, err := readRData(buf, qtype, 0); err == nil {
+			t.Errorf("%s: empty rdata accepted", qtype)
+		}
+	}
+}
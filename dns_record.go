@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"time"
 )
@@ -11,10 +12,7 @@ type DnsRecord struct {
 	Type  QType
 	Class QClass
 	TTL   uint32
-	Data  []byte // raw RDATA
-	// parsed helpers
-	AData net.IP
-	CName string
+	RData RData // decoded RDATA; *RDataOpaque for unknown types
 }
 
 func (r *DnsRecord) Write(buf *BytePacketBuffer) error {
@@ -30,64 +28,64 @@ func (r *DnsRecord) Write(buf *BytePacketBuffer) error {
 	if err := buf.WriteUint32(r.TTL); err != nil {
 		return err
 	}
-	if err := buf.WriteUint16(uint16(len(r.Data))); err != nil {
+	// RDLENGTH is back-filled once RDATA is written, since compressed names
+	// inside RDATA make its final size depend on what precedes it
+	lenPos := buf.Current()
+	if err := buf.WriteUint16(0); err != nil {
 		return err
 	}
-	if len(r.Data) > 0 {
-		if err := buf.Write(r.Data); err != nil {
+	if r.RData != nil {
+		if err := r.RData.Write(buf); err != nil {
 			return err
 		}
 	}
+	end := buf.Current()
+	rdlen := end - lenPos - 2
+	if rdlen > 0xFFFF {
+		return errors.New("rdata too long")
+	}
+	buf.pos = lenPos
+	if err := buf.WriteUint16(uint16(rdlen)); err != nil {
+		return err
+	}
+	buf.pos = end
 	return nil
 }
 
 func ReadRecord(buf *BytePacketBuffer) (*DnsRecord, error) {
 	name, err := buf.ReadQName()
-	if err != nil { return nil, err }
+	if err != nil {
+		return nil, err
+	}
 	t, err := buf.ReadUint16()
-	if err != nil { return nil, err }
+	if err != nil {
+		return nil, err
+	}
 	c, err := buf.ReadUint16()
-	if err != nil { return nil, err }
+	if err != nil {
+		return nil, err
+	}
 	ttl, err := buf.ReadUint32()
-	if err != nil { return nil, err }
+	if err != nil {
+		return nil, err
+	}
 	rdlen, err := buf.ReadUint16()
-	if err != nil { return nil, err }
-
-	if rdlen == 0 {
-		return &DnsRecord{
-			Name: name,
-			Type: QType(t),
-			Class: QClass(c),
-			TTL: ttl,
-			Data: []byte{},
-		}, nil
+	if err != nil {
+		return nil, err
 	}
 
-	if buf.pos+int(rdlen) > len(buf.buf) {
-		return nil, errors.New("rdata too long")
+	rdata, err := readRData(buf, QType(t), int(rdlen))
+	if err != nil {
+		return nil, err
 	}
-	rdata := make([]byte, rdlen)
-	copy(rdata, buf.buf[buf.pos:buf.pos+int(rdlen)])
-	buf.pos += int(rdlen)
 
-	rec := &DnsRecord{
-		Name: name,
-		Type: QType(t),
+	return &DnsRecord{
+		Name:  name,
+		Type:  QType(t),
 		Class: QClass(c),
-		TTL: ttl,
-		Data: rdata,
-	}
-	switch rec.Type {
-	case QTypeA:
-		if len(rdata) == 4 {
-			rec.AData = net.IPv4(rdata[0], rdata[1], rdata[2], rdata[3])
-		}
-	case QTypeAAAA:
-		if len(rdata) == 16 {
-			rec.AData = net.IP(rdata)
-		}
-	}
-	return rec, nil
+		TTL:   ttl,
+		RData: rdata,
+	}, nil
 }
 
 func NewARecord(name string, ipStr string, ttlSeconds uint32) (*DnsRecord, error) {
@@ -99,18 +97,25 @@ func NewARecord(name string, ipStr string, ttlSeconds uint32) (*DnsRecord, error
 	if ip == nil {
 		return nil, errors.New("not ipv4")
 	}
-	data := []byte{ip[0], ip[1], ip[2], ip[3]}
 	rec := &DnsRecord{
-		Name: name,
-		Type: QTypeA,
+		Name:  name,
+		Type:  QTypeA,
 		Class: QClassIN,
-		TTL: ttlSeconds,
-		Data: data,
-		AData: ip,
+		TTL:   ttlSeconds,
+		RData: &RDataA{IP: ip},
 	}
 	return rec, nil
 }
 
+// String formats the record as a master file line
+func (r *DnsRecord) String() string {
+	rdata := ""
+	if r.RData != nil {
+		rdata = r.RData.String()
+	}
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", fqdn(r.Name), r.TTL, r.Class, r.Type, rdata)
+}
+
 func (r *DnsRecord) ExpiryTime() time.Time {
 	return time.Now().Add(time.Duration(r.TTL) * time.Second)
 }
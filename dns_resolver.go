@@ -1,79 +1,81 @@
 package main
 
-import (
-	"net"
-	"time"
-	"log"
-)
+import "fmt"
 
-// DnsResolver handles forwarding queries to an upstream server
+// DnsResolver handles forwarding queries to a pool of upstream servers
 type DnsResolver struct {
-	upstream string
-	timeout  time.Duration
+	pool      *UpstreamPool      // default upstreams
+	forwards  *ForwardTable      // per-suffix upstreams, may be nil
+	iterative *IterativeResolver // resolve from the root instead of forwarding, may be nil
+	ednsSize  uint16             // UDP payload size advertised upstream, 0 disables EDNS
+	dnssecOK  bool               // set the DO bit so upstream returns DNSSEC records
+	use0x20   bool               // randomize the case of query names (DNS 0x20)
 }
 
-func NewDnsResolver(upstream string) *DnsResolver {
+func NewDnsResolver(pool *UpstreamPool) *DnsResolver {
 	return &DnsResolver{
-		upstream: upstream,
-		timeout:  3 * time.Second,
+		pool:     pool,
+		ednsSize: DefaultEDNSSize,
+		dnssecOK: true,
 	}
 }
 
-// RecursiveLookup forwards the raw query and returns the parsed upstream packet
-func (r *DnsResolver) RecursiveLookup(name string, qtype QType) (*DnsPacket, error) {
-	// Build question-only packet (we can forward original query bytes instead).
-	// Simpler: create a UDP connection to upstream and forward the raw packet
-	// but we don't have the original raw bytes here; instead create a minimal query.
-
-	// We'll create a very small query: but easiest approach — use net.Dial and send a properly formatted query:
-	// For simplicity we will forward a new query built from scratch.
-	// Build a DnsPacket
-	pkt := NewDnsPacket()
-	// random ID
-	pkt.Header.ID = uint16(time.Now().UnixNano() & 0xffff)
-	pkt.Header.RecursionDesired = true
-	pkt.Questions = append(pkt.Questions, &DnsQuestion{
-		Name: name,
-		QType: qtype,
-		QClass: QClassIN,
-	})
-
-	// serialize
-	raw, err := pkt.ToBytes()
-	if err != nil {
-		return nil, err
+// RecursiveLookup forwards the question upstream, or resolves it iteratively
+// when enabled, and returns the resulting packet. The class is passed on
+// unchanged; iterative resolution only supports IN.
+func (r *DnsResolver) RecursiveLookup(name string, qtype QType, qclass QClass) (*DnsPacket, error) {
+	// conditional forwarding still applies in iterative mode
+	if r.iterative != nil {
+		if _, _, forwarded := r.forwards.Lookup(name); !forwarded {
+			if qclass != QClassIN {
+				return nil, fmt.Errorf("iterative resolution of class %s is not supported", qclass)
+			}
+			return r.iterative.Resolve(name, qtype)
+		}
 	}
-
-	// send to upstream
-	raddr, err := net.ResolveUDPAddr("udp", r.upstream)
+	resp, err := r.lookup(name, qtype, qclass, r.ednsSize)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialUDP("udp", nil, raddr)
-	if err != nil {
-		return nil, err
+	// upstreams that don't understand EDNS answer FORMERR without an OPT
+	// record; retry once without it (RFC 6891 7)
+	if r.ednsSize > 0 && resp.Header.RESCODE == FORMERR && resp.Edns == nil {
+		return r.lookup(name, qtype, qclass, 0)
 	}
-	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(r.timeout))
+	return resp, nil
+}
 
-	if _, err := conn.Write(raw); err != nil {
-		return nil, err
+func (r *DnsResolver) lookup(name string, qtype QType, qclass QClass, ednsSize uint16) (*DnsPacket, error) {
+	// We don't have the client's raw bytes here, so build a fresh query;
+	// the ID is picked at random per attempt when it is sent
+	sent := name
+	if r.use0x20 {
+		sent = randomizeCase(name)
+	}
+	pkt := NewDnsPacket()
+	pkt.Header.RecursionDesired = true
+	pkt.Questions = append(pkt.Questions, &DnsQuestion{
+		Name:   sent,
+		QType:  qtype,
+		QClass: qclass,
+	})
+	if ednsSize > 0 {
+		pkt.Edns = &Edns{UDPSize: ednsSize, DO: r.dnssecOK}
 	}
 
-	resp := make([]byte, 2048)
-	n, err := conn.Read(resp)
+	resp, err := r.poolFor(name).Exchange(pkt, r.use0x20)
 	if err != nil {
 		return nil, err
 	}
-	respCopy := make([]byte, n)
-	copy(respCopy, resp[:n])
+	restoreCase(resp, sent, name)
+	scrubResponse(resp, name, qtype, "")
+	return resp, nil
+}
 
-	// parse upstream response
-	upPkt, err := FromBytes(respCopy)
-	if err != nil {
-		// log parse error but still return raw payload as nil error
-		log.Printf("warning: failed to parse upstream response: %v", err)
-		return nil, err
+// poolFor picks the forwarding pool for name, falling back to the default
+func (r *DnsResolver) poolFor(name string) *UpstreamPool {
+	if pool, _, ok := r.forwards.Lookup(name); ok {
+		return pool
 	}
-	return upPkt, nil
+	return r.pool
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecursiveLookupKeepsClass(t *testing.T) {
+	s := startFakeServer(t, "127.0.0.1:0", func(q *DnsPacket) *DnsPacket {
+		if q.Questions[0].QClass != QClassCH {
+			return reply(q, REFUSED)
+		}
+		return reply(q, NOERROR, &DnsRecord{Name: q.Questions[0].Name, Type: QTypeTXT, Class: QClassCH, TTL: 0, RData: &RDataTXT{Strings: []string{"fake"}}})
+	})
+	r := NewDnsResolver(NewUpstreamPool([]*Upstream{{Addr: s.addr, Timeout: time.Second}}, PolicyOrdered))
+
+	resp, err := r.RecursiveLookup("version.bind", QTypeTXT, QClassCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 || resp.Answers[0].Class != QClassCH {
+		t.Fatalf("got %d answers, want one CH TXT record", len(resp.Answers))
+	}
+
+	r.iterative = NewIterativeResolver([]string{s.addr})
+	if _, err := r.RecursiveLookup("version.bind", QTypeTXT, QClassCH); err == nil {
+		t.Fatal("iterative lookup of a CH question succeeded")
+	}
+}
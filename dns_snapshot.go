@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Cache snapshot file layout (all integers big-endian):
+//
+//	header:  magic "DNSCACHE", version u16
+//	entry:   name (u16 length + bytes), qtype u16, qclass u16, rcode u8,
+//	         expiry (unix nanoseconds) i64, lifetime (seconds) u32,
+//	         answer/authority/additional counts u16 x3,
+//	         records (u16 length + uncompressed wire format) ...
+//
+// Each shard's entries are written least recently used first, so loading
+// them in order restores the LRU order. Bump snapshotVersion whenever the layout changes.
+const (
+	snapshotMagic   = "DNSCACHE"
+	snapshotVersion = 1
+)
+
+// SaveSnapshot writes all live entries to path. The file is replaced
+// atomically so a crash never leaves a partial snapshot behind.
+func (c *DnsCache) SaveSnapshot(path string) (int, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	n, err := c.WriteSnapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot reads a snapshot written by SaveSnapshot. A missing file is
+// not an error.
+func (c *DnsCache) LoadSnapshot(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return c.ReadSnapshot(bufio.NewReader(f))
+}
+
+type snapshotEntry struct {
+	question DnsQuestion
+	item     *CacheItem
+	lifetime time.Duration
+}
+
+// WriteSnapshot encodes every unexpired entry to w and returns how many
+// were written
+func (c *DnsCache) WriteSnapshot(w io.Writer) (int, error) {
+	now := time.Now()
+	var entries []snapshotEntry
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		for el := sh.lru.Back(); el != nil; el = el.Prev() {
+			e := el.Value.(*cacheEntry)
+			if now.Before(e.item.Expiry) {
+				entries = append(entries, snapshotEntry{e.question, e.item, e.ttl})
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint16(snapshotVersion)); err != nil {
+		return 0, err
+	}
+	buf := NewPacketBufferWithSize(0xFFFF)
+	buf.SetCompression(false)
+	for i, e := range entries {
+		if err := writeSnapshotEntry(w, buf, e); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+func writeSnapshotEntry(w io.Writer, buf *BytePacketBuffer, e snapshotEntry) error {
+	if len(e.question.Name) > 0xFFFF {
+		return errors.New("name too long")
+	}
+	fixed := []any{
+		uint16(len(e.question.Name)), []byte(e.question.Name),
+		uint16(e.question.QType), uint16(e.question.QClass), uint8(e.item.RCode),
+		e.item.Expiry.UnixNano(), uint32(e.lifetime / time.Second),
+		uint16(len(e.item.Answers)), uint16(len(e.item.Authorities)), uint16(len(e.item.Resources)),
+	}
+	for _, v := range fixed {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	for _, records := range [][]*DnsRecord{e.item.Answers, e.item.Authorities, e.item.Resources} {
+		for _, r := range records {
+			buf.pos = 0
+			if err := r.Write(buf); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.BigEndian, uint16(buf.Len())); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadSnapshot loads entries from r, skipping those that have expired in
+// the meantime, and returns how many were loaded
+func (c *DnsCache) ReadSnapshot(r io.Reader) (int, error) {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return 0, fmt.Errorf("reading snapshot header: %w", err)
+	}
+	if string(magic) != snapshotMagic {
+		return 0, errors.New("not a cache snapshot")
+	}
+	var version uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return 0, fmt.Errorf("reading snapshot header: %w", err)
+	}
+	if version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d (want %d)", version, snapshotVersion)
+	}
+
+	loaded := 0
+	now := time.Now()
+	for {
+		e, err := readSnapshotEntry(r)
+		if err == io.EOF {
+			return loaded, nil
+		}
+		if err != nil {
+			return loaded, fmt.Errorf("reading snapshot entry %d: %w", loaded, err)
+		}
+		if now.Before(e.item.Expiry) {
+			c.store(&e.question, e.item, e.lifetime)
+			loaded++
+		}
+	}
+}
+
+func readSnapshotEntry(r io.Reader) (*snapshotEntry, error) {
+	var nameLen uint16
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		// a clean EOF between entries ends the snapshot
+		return nil, err
+	}
+	name := make([]byte, nameLen)
+	var fixed struct {
+		QType, QClass uint16
+		RCode         uint8
+		Expiry        int64
+		Lifetime      uint32
+		AN, NS, AR    uint16
+	}
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &fixed); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	e := &snapshotEntry{
+		question: DnsQuestion{Name: string(name), QType: QType(fixed.QType), QClass: QClass(fixed.QClass)},
+		item: &CacheItem{
+			RCode:  RCode(fixed.RCode),
+			Expiry: time.Unix(0, fixed.Expiry),
+		},
+		lifetime: time.Duration(fixed.Lifetime) * time.Second,
+	}
+	var err error
+	if e.item.Answers, err = readSnapshotRecords(r, fixed.AN); err != nil {
+		return nil, err
+	}
+	if e.item.Authorities, err = readSnapshotRecords(r, fixed.NS); err != nil {
+		return nil, err
+	}
+	if e.item.Resources, err = readSnapshotRecords(r, fixed.AR); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func readSnapshotRecords(r io.Reader, count uint16) ([]*DnsRecord, error) {
+	records := make([]*DnsRecord, 0, count)
+	for i := 0; i < int(count); i++ {
+		var l uint16
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		buf := NewPacketBufferWithSize(int(l))
+		if _, err := io.ReadFull(r, buf.buf); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		rec, err := ReadRecord(buf)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// unexpectedEOF turns an EOF in the middle of an entry into an error
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
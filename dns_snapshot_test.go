@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	c := NewDnsCache()
+	q := &DnsQuestion{Name: "www.example.com", QType: QTypeA, QClass: QClassIN}
+	c.Put(q, reply(aQuery(q.Name), NOERROR, mustA(t, q.Name, "192.0.2.1")))
+	nx := &DnsQuestion{Name: "missing.example.com", QType: QTypeA, QClass: QClassIN}
+	c.Put(nx, negativeResponse(NXDOMAIN, 3600, 120))
+	// expired, only servable stale: not worth saving
+	old := &DnsQuestion{Name: "old.example.com", QType: QTypeA, QClass: QClassIN}
+	c.store(old, &CacheItem{RCode: NOERROR, Expiry: time.Now().Add(-time.Second)}, time.Minute)
+
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	if n, err := c.SaveSnapshot(path); err != nil || n != 2 {
+		t.Fatalf("saved %d entries (%v), want 2", n, err)
+	}
+	loaded := NewDnsCache()
+	if n, err := loaded.LoadSnapshot(path); err != nil || n != 2 {
+		t.Fatalf("loaded %d entries (%v), want 2", n, err)
+	}
+
+	want, _ := c.Get(q.Name, q.QType, q.QClass)
+	got, ok := loaded.Get(q.Name, q.QType, q.QClass)
+	if !ok || len(got.Answers) != 1 {
+		t.Fatalf("reloaded %s: found %v with %d answers", q.Name, ok, len(got.Answers))
+	}
+	// the remaining TTL may tick over between the two Gets
+	if !got.Expiry.Equal(want.Expiry) || got.Answers[0].TTL+1 < want.Answers[0].TTL {
+		t.Errorf("reloaded TTL %d expiring %v, want %d expiring %v", got.Answers[0].TTL, got.Expiry, want.Answers[0].TTL, want.Expiry)
+	}
+	if got.Answers[0].RData.(*RDataA).IP.String() != "192.0.2.1" {
+		t.Errorf("reloaded address %v", got.Answers[0].RData)
+	}
+	if got, ok := loaded.Get(nx.Name, nx.QType, nx.QClass); !ok || got.RCode != NXDOMAIN || got.Authorities[0].TTL > 120 {
+		t.Errorf("reloaded negative entry: found %v", ok)
+	}
+	if _, ok := loaded.GetStale(old.Name, old.QType, old.QClass); ok {
+		t.Error("expired entry was saved")
+	}
+}
+
+func TestSnapshotDropsEntriesExpiredSinceSave(t *testing.T) {
+	c := NewDnsCache()
+	short := &DnsQuestion{Name: "short.example.com", QType: QTypeA, QClass: QClassIN}
+	c.store(short, &CacheItem{RCode: NOERROR, Expiry: time.Now().Add(20 * time.Millisecond)}, time.Second)
+	long := &DnsQuestion{Name: "long.example.com", QType: QTypeA, QClass: QClassIN}
+	c.store(long, &CacheItem{RCode: NOERROR, Expiry: time.Now().Add(time.Hour)}, time.Hour)
+
+	var buf bytes.Buffer
+	if n, err := c.WriteSnapshot(&buf); err != nil || n != 2 {
+		t.Fatalf("wrote %d entries (%v), want 2", n, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	loaded := NewDnsCache()
+	if n, err := loaded.ReadSnapshot(&buf); err != nil || n != 1 {
+		t.Fatalf("read %d entries (%v), want 1", n, err)
+	}
+	if _, ok := loaded.Get(long.Name, long.QType, long.QClass); !ok {
+		t.Error("unexpired entry not loaded")
+	}
+}
+
+func TestSnapshotRejectsBadFiles(t *testing.T) {
+	c := NewDnsCache()
+	q := &DnsQuestion{Name: "www.example.com", QType: QTypeA, QClass: QClassIN}
+	c.Put(q, reply(aQuery(q.Name), NOERROR, mustA(t, q.Name, "192.0.2.1")))
+	var buf bytes.Buffer
+	if _, err := c.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+	header := len(snapshotMagic) + 2
+
+	badVersion := bytes.Clone(good)
+	binary.BigEndian.PutUint16(badVersion[len(snapshotMagic):], snapshotVersion+1)
+
+	tests := []struct {
+		desc string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "header"},
+		{"bad magic", append([]byte("NOTCACHE"), good[len(snapshotMagic):]...), "not a cache snapshot"},
+		{"bad version", badVersion, "unsupported snapshot version"},
+		{"truncated header", good[:header-1], "header"},
+		{"truncated entry", good[:header+5], io.ErrUnexpectedEOF.Error()},
+		{"truncated record", good[:len(good)-1], io.ErrUnexpectedEOF.Error()},
+	}
+	for _, tt := range tests {
+		_, err := NewDnsCache().ReadSnapshot(bytes.NewReader(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one mentioning %q", tt.desc, err, tt.want)
+		}
+	}
+}
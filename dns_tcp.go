@@ -1,107 +1,180 @@
 package main
 
 import (
-    "io"
-    "log"
-    "net"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
 )
 
-func (s *DnsServer) StartTCP() error {
-    addr := fmt.Sprintf("0.0.0.0:%d", s.port)
-
-    ln, err := net.Listen("tcp", addr)
-    if err != nil {
-        return fmt.Errorf("❌ TCP listen failed: %w", err)
-    }
-
-    log.Printf("🔌 TCP DNS Server started on %s", addr)
-
-    go func() {
-        for {
-            conn, err := ln.Accept()
-            if err != nil {
-                log.Printf("❌ TCP accept failed: %v", err)
-                continue
-            }
-            go s.handleTCPConn(conn)
-        }
-    }()
+const (
+	// RFC 7766 6.2.3 suggests an idle timeout of the order of seconds
+	DefaultTCPIdleTimeout      = 10 * time.Second
+	DefaultTCPMessageTimeout   = 2 * time.Second
+	DefaultTCPMaxConns         = 1000
+	DefaultMaxPipelinedQueries = 64 // concurrent queries per connection
+)
 
-    return nil
+// startTCPServer listens for DNS over TCP on the server port
+func (s *DnsServer) startTCPServer() error {
+	addr := fmt.Sprintf("0.0.0.0:%d", s.port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to bind TCP port %d: %w", s.port, err)
+	}
+
+	log.Printf("🚀 DNS TCP Server started on %s", addr)
+	go s.acceptStreams(ln, "TCP", s.tcpMaxConns, s.tcpIdleTimeout)
+	return nil
 }
 
-func (s *DnsServer) handleTCPConn(conn net.Conn) {
-    defer conn.Close()
-
-    // TCP DNS packets have a 2-byte length prefix
-    lengthBuf := make([]byte, 2)
-    if _, err := io.ReadFull(conn, lengthBuf); err != nil {
-        return
-    }
-    size := int(lengthBuf[0])<<8 | int(lengthBuf[1])
-
-    // Read full DNS message
-    buf := make([]byte, size)
-    if _, err := io.ReadFull(conn, buf); err != nil {
-        return
-    }
-
-    // Parse DNS request
-    requestPacket, err := FromBytes(buf)
-    if err != nil {
-        log.Printf("❌ TCP parse error: %v", err)
-        return
-    }
-
-    // Prepare response using the SAME logic used for UDP
-    responsePacket := s.makeResponseFromPacket(requestPacket)
-
-    respBytes, err := responsePacket.ToBytes()
-    if err != nil {
-        log.Printf("❌ TCP encode error: %v", err)
-        return
-    }
-
-    // Write length prefix
-    header := []byte{byte(len(respBytes) >> 8), byte(len(respBytes))}
-    conn.Write(header)
-    conn.Write(respBytes)
-
-    log.Printf("📤 TCP response sent (size: %d bytes)", len(respBytes))
+// acceptStreams serves every connection accepted on ln with serveDNSStream,
+// turning connections away while maxConns are already open
+func (s *DnsServer) acceptStreams(ln net.Listener, proto string, maxConns int, idleTimeout time.Duration) {
+	conns := make(chan struct{}, maxConns)
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("❌ %s accept error: %v", proto, err)
+			continue
+		}
+		select {
+		case conns <- struct{}{}:
+		default:
+			log.Printf("❌ %s connection limit (%d) reached, dropping %s", proto, maxConns, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-conns }()
+			s.serveDNSStream(conn, proto, idleTimeout)
+		}()
+	}
 }
 
-// Shared response creation logic (factored out)
-func (s *DnsServer) makeResponseFromPacket(requestPacket *DnsPacket) *DnsPacket {
-    responsePacket := NewDnsPacket()
-    responsePacket.Header.ID = requestPacket.Header.ID
-    responsePacket.Header.Response = true
-    responsePacket.Header.Opcode = requestPacket.Header.Opcode
-    responsePacket.Header.RecursionDesired = requestPacket.Header.RecursionDesired
-    responsePacket.Header.RecursionAvailable = true
-
-    responsePacket.Questions = requestPacket.Questions
-
-    for _, question := range requestPacket.Questions {
-        if cached, found := s.cache.Get(question.Name, question.QType); found {
-            responsePacket.Answers = append(responsePacket.Answers, cached)
-            responsePacket.Header.RESCODE = NOERROR
-            continue
-        }
-
-        upstreamPacket, err := s.resolver.RecursiveLookup(question.Name, question.QType)
-        if err != nil {
-            responsePacket.Header.RESCODE = SERVFAIL
-            continue
-        }
+// serveDNSStream answers length-prefixed queries on a stream connection
+// (TCP or TLS) until the client closes it or stays idle for idleTimeout.
+// Once a length prefix arrives the message itself must follow within
+// tcpMessageTimeout. Queries are processed concurrently as they arrive, so
+// responses go out in whatever order they complete (RFC 7766 6.2.1.1);
+// clients match them by ID.
+func (s *DnsServer) serveDNSStream(conn net.Conn, proto string, idleTimeout time.Duration) {
+	client := conn.RemoteAddr().String()
+	var wmu sync.Mutex // one response written at a time
+	var wg sync.WaitGroup
+	inflight := make(chan struct{}, DefaultMaxPipelinedQueries)
+	defer func() {
+		wg.Wait()
+		conn.Close()
+	}()
+
+	lengthBuf := make([]byte, 2)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(s.tcpMessageTimeout))
+		msg := make([]byte, binary.BigEndian.Uint16(lengthBuf))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			log.Printf("❌ %s failed reading message from %s: %v", proto, client, err)
+			return
+		}
+		packet, err := FromBytes(msg)
+		if err != nil {
+			log.Printf("❌ %s parse failed from %s: %v", proto, client, err)
+			if resp := formErrResponse(msg); resp != nil {
+				wmu.Lock()
+				conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+				err = writeTCPMessage(conn, resp)
+				wmu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+			continue
+		}
+
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inflight
+				wg.Done()
+			}()
+			startTime := time.Now()
+			response := s.buildResponse(packet, client)
+			tcpKeepalive(packet, response, idleTimeout)
+			responseBytes, err := response.ToBytesWithSize(0xFFFF)
+			if err != nil {
+				log.Printf("❌ %s encode failed: %v", proto, err)
+				return
+			}
+			wmu.Lock()
+			conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+			err = writeTCPMessage(conn, responseBytes)
+			wmu.Unlock()
+			if err != nil {
+				log.Printf("❌ %s write to %s failed: %v", proto, client, err)
+				return
+			}
+			log.Printf("📤 %s Response sent to %s in %v (size: %d bytes)",
+				proto, client, time.Since(startTime), len(responseBytes))
+		}()
+	}
+}
 
-        responsePacket.Answers = append(responsePacket.Answers, upstreamPacket.Answers...)
-        responsePacket.Authorities = append(responsePacket.Authorities, upstreamPacket.Authorities...)
-        responsePacket.Resources = append(responsePacket.Resources, upstreamPacket.Resources...)
+// tcpKeepalive answers an edns-tcp-keepalive option in req with the idle
+// timeout in units of 100ms (RFC 7828 3.3.2). A client may not send a
+// timeout of its own; doing so is a FORMERR.
+func tcpKeepalive(req, resp *DnsPacket, idleTimeout time.Duration) {
+	opt, ok := req.Edns.option(ednsOptionTCPKeepalive)
+	if !ok || resp.Edns == nil {
+		return
+	}
+	if len(opt.Data) != 0 {
+		resp.Answers, resp.Authorities, resp.Resources = nil, nil, nil
+		resp.Header.RESCODE = FORMERR
+		return
+	}
+	timeout := min(idleTimeout/(100*time.Millisecond), 0xFFFF)
+	resp.Edns.Options = append(resp.Edns.Options, EdnsOption{
+		Code: ednsOptionTCPKeepalive,
+		Data: binary.BigEndian.AppendUint16(nil, uint16(timeout)),
+	})
+}
 
-        s.cache.PutMultiple(upstreamPacket.Answers)
-        responsePacket.Header.RESCODE = upstreamPacket.Header.RESCODE
-    }
+// readTCPMessage reads one DNS message with its 2-byte length prefix
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	lengthBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, lengthBuf); err != nil {
+		return nil, err
+	}
+	size := int(lengthBuf[0])<<8 | int(lengthBuf[1])
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
 
-    return responsePacket
+// writeTCPMessage writes msg prefixed with its length in a single write
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return fmt.Errorf("message too large for TCP: %d bytes", len(msg))
+	}
+	framed := make([]byte, 2+len(msg))
+	framed[0] = byte(len(msg) >> 8)
+	framed[1] = byte(len(msg))
+	copy(framed[2:], msg)
+	_, err := w.Write(framed)
+	return err
 }
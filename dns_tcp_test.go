@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTestTCPServer serves s over TCP on a free loopback port
+func startTestTCPServer(t *testing.T, s *DnsServer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.acceptStreams(ln, "TCP", s.tcpMaxConns, s.tcpIdleTimeout)
+	return ln.Addr().String()
+}
+
+func dialTCP(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func sendTCPQuery(t *testing.T, conn net.Conn, q *DnsPacket) {
+	t.Helper()
+	data, err := q.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTCPMessage(conn, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTCPResponse(t *testing.T, conn net.Conn) *DnsPacket {
+	t.Helper()
+	msg, err := readTCPMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := FromBytes(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestTCPPipelinedResponsesOutOfOrder(t *testing.T) {
+	release := make(chan struct{})
+	s, _ := newTestServer(t, func(q *DnsPacket) *DnsPacket {
+		name := q.Questions[0].Name
+		if name == "slow.example.com" {
+			<-release
+		}
+		return reply(q, NOERROR, mustA(t, name, "192.0.2.1"))
+	})
+	s.staleAnswerTimeout = 0
+	conn := dialTCP(t, startTestTCPServer(t, s))
+
+	slow, fast := aQuery("slow.example.com"), aQuery("fast.example.com")
+	slow.Header.ID, fast.Header.ID = 1, 2
+	sendTCPQuery(t, conn, slow)
+	sendTCPQuery(t, conn, fast)
+
+	if resp := readTCPResponse(t, conn); resp.Header.ID != 2 {
+		t.Fatalf("first response has ID %d, want the fast query's 2", resp.Header.ID)
+	}
+	close(release)
+	if resp := readTCPResponse(t, conn); resp.Header.ID != 1 || len(resp.Answers) != 1 {
+		t.Fatalf("second response has ID %d with %d answers, want the slow query's 1", resp.Header.ID, len(resp.Answers))
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	s := NewDnsServer(0)
+	s.tcpIdleTimeout = 100 * time.Millisecond
+	conn := dialTCP(t, startTestTCPServer(t, s))
+
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read data from an idle connection")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("idle connection closed after %v, want about %v", elapsed, s.tcpIdleTimeout)
+	}
+}
+
+func TestTCPKeepaliveOption(t *testing.T) {
+	s, _ := newTestServer(t, func(q *DnsPacket) *DnsPacket {
+		return reply(q, NOERROR, mustA(t, q.Questions[0].Name, "192.0.2.1"))
+	})
+	s.tcpIdleTimeout = 5 * time.Second
+	conn := dialTCP(t, startTestTCPServer(t, s))
+
+	q := aQuery("example.com")
+	q.Edns = &Edns{UDPSize: 1232, Options: []EdnsOption{{Code: ednsOptionTCPKeepalive}}}
+	sendTCPQuery(t, conn, q)
+	resp := readTCPResponse(t, conn)
+	opt, ok := resp.Edns.option(ednsOptionTCPKeepalive)
+	if !ok || len(opt.Data) != 2 || binary.BigEndian.Uint16(opt.Data) != 50 {
+		t.Fatalf("got keepalive option %v (present %v), want a timeout of 50 (5s)", opt.Data, ok)
+	}
+
+	// clients must not send a timeout of their own (RFC 7828 3.2.1)
+	q.Edns.Options[0].Data = []byte{0, 10}
+	sendTCPQuery(t, conn, q)
+	if resp := readTCPResponse(t, conn); resp.Header.RESCODE != FORMERR {
+		t.Fatalf("got %s for a query carrying a keepalive timeout, want FORMERR", resp.Header.RESCODE)
+	}
+}
+
+func TestTCPConnectionLimit(t *testing.T) {
+	s, _ := newTestServer(t, func(q *DnsPacket) *DnsPacket {
+		return reply(q, NOERROR, mustA(t, q.Questions[0].Name, "192.0.2.1"))
+	})
+	s.tcpMaxConns = 1
+	addr := startTestTCPServer(t, s)
+
+	first := dialTCP(t, addr)
+	sendTCPQuery(t, first, aQuery("example.com"))
+	readTCPResponse(t, first)
+
+	second := dialTCP(t, addr)
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection over the limit was served")
+	}
+	// the open connection keeps working
+	sendTCPQuery(t, first, aQuery("example.com"))
+	readTCPResponse(t, first)
+}
+
+func TestTCPFormErrOnUnparsableQuery(t *testing.T) {
+	s, _ := newTestServer(t, func(q *DnsPacket) *DnsPacket {
+		return reply(q, NOERROR, mustA(t, q.Questions[0].Name, "192.0.2.1"))
+	})
+	conn := dialTCP(t, startTestTCPServer(t, s))
+
+	// a header promising one question that never follows
+	if err := writeTCPMessage(conn, []byte{0xBE, 0xEF, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	resp := readTCPResponse(t, conn)
+	if resp.Header.ID != 0xBEEF || !resp.Header.Response || resp.Header.RESCODE != FORMERR {
+		t.Fatalf("got ID %#x rcode %s, want FORMERR for ID 0xbeef", resp.Header.ID, resp.Header.RESCODE)
+	}
+
+	// too short to carry an ID: ignored, and the connection stays usable
+	if err := writeTCPMessage(conn, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	q := aQuery("example.com")
+	q.Header.ID = 7
+	sendTCPQuery(t, conn, q)
+	if resp := readTCPResponse(t, conn); resp.Header.ID != 7 || resp.Header.RESCODE != NOERROR {
+		t.Fatalf("got ID %d rcode %s after a short message, want the answer to query 7", resp.Header.ID, resp.Header.RESCODE)
+	}
+}
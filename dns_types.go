@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type QType uint16
+type QClass uint16
+
+// Resource record types from the IANA "Resource Record (RR) TYPEs" registry
+const (
+	QTypeA          QType = 1
+	QTypeNS         QType = 2
+	QTypeMD         QType = 3
+	QTypeMF         QType = 4
+	QTypeCNAME      QType = 5
+	QTypeSOA        QType = 6
+	QTypeMB         QType = 7
+	QTypeMG         QType = 8
+	QTypeMR         QType = 9
+	QTypeNULL       QType = 10
+	QTypeWKS        QType = 11
+	QTypePTR        QType = 12
+	QTypeHINFO      QType = 13
+	QTypeMINFO      QType = 14
+	QTypeMX         QType = 15
+	QTypeTXT        QType = 16
+	QTypeRP         QType = 17
+	QTypeAFSDB      QType = 18
+	QTypeX25        QType = 19
+	QTypeISDN       QType = 20
+	QTypeRT         QType = 21
+	QTypeNSAP       QType = 22
+	QTypeNSAPPTR    QType = 23
+	QTypeSIG        QType = 24
+	QTypeKEY        QType = 25
+	QTypePX         QType = 26
+	QTypeGPOS       QType = 27
+	QTypeAAAA       QType = 28
+	QTypeLOC        QType = 29
+	QTypeNXT        QType = 30
+	QTypeEID        QType = 31
+	QTypeNIMLOC     QType = 32
+	QTypeSRV        QType = 33
+	QTypeATMA       QType = 34
+	QTypeNAPTR      QType = 35
+	QTypeKX         QType = 36
+	QTypeCERT       QType = 37
+	QTypeA6         QType = 38
+	QTypeDNAME      QType = 39
+	QTypeSINK       QType = 40
+	QTypeOPT        QType = 41
+	QTypeAPL        QType = 42
+	QTypeDS         QType = 43
+	QTypeSSHFP      QType = 44
+	QTypeIPSECKEY   QType = 45
+	QTypeRRSIG      QType = 46
+	QTypeNSEC       QType = 47
+	QTypeDNSKEY     QType = 48
+	QTypeDHCID      QType = 49
+	QTypeNSEC3      QType = 50
+	QTypeNSEC3PARAM QType = 51
+	QTypeTLSA       QType = 52
+	QTypeSMIMEA     QType = 53
+	QTypeHIP        QType = 55
+	QTypeNINFO      QType = 56
+	QTypeRKEY       QType = 57
+	QTypeTALINK     QType = 58
+	QTypeCDS        QType = 59
+	QTypeCDNSKEY    QType = 60
+	QTypeOPENPGPKEY QType = 61
+	QTypeCSYNC      QType = 62
+	QTypeZONEMD     QType = 63
+	QTypeSVCB       QType = 64
+	QTypeHTTPS      QType = 65
+	QTypeDSYNC      QType = 66
+	QTypeSPF        QType = 99
+	QTypeUINFO      QType = 100
+	QTypeUID        QType = 101
+	QTypeGID        QType = 102
+	QTypeUNSPEC     QType = 103
+	QTypeNID        QType = 104
+	QTypeL32        QType = 105
+	QTypeL64        QType = 106
+	QTypeLP         QType = 107
+	QTypeEUI48      QType = 108
+	QTypeEUI64      QType = 109
+	QTypeTKEY       QType = 249
+	QTypeTSIG       QType = 250
+	QTypeIXFR       QType = 251
+	QTypeAXFR       QType = 252
+	QTypeMAILB      QType = 253
+	QTypeMAILA      QType = 254
+	QTypeANY        QType = 255
+	QTypeURI        QType = 256
+	QTypeCAA        QType = 257
+	QTypeAVC        QType = 258
+	QTypeDOA        QType = 259
+	QTypeAMTRELAY   QType = 260
+	QTypeRESINFO    QType = 261
+	QTypeWALLET     QType = 262
+	QTypeTA         QType = 32768
+	QTypeDLV        QType = 32769
+)
+
+const (
+	QClassIN   QClass = 1
+	QClassCH   QClass = 3
+	QClassHS   QClass = 4
+	QClassNONE QClass = 254
+	QClassANY  QClass = 255
+)
+
+var qtypeNames = map[QType]string{
+	QTypeA: "A", QTypeNS: "NS", QTypeMD: "MD", QTypeMF: "MF",
+	QTypeCNAME: "CNAME", QTypeSOA: "SOA", QTypeMB: "MB", QTypeMG: "MG",
+	QTypeMR: "MR", QTypeNULL: "NULL", QTypeWKS: "WKS", QTypePTR: "PTR",
+	QTypeHINFO: "HINFO", QTypeMINFO: "MINFO", QTypeMX: "MX", QTypeTXT: "TXT",
+	QTypeRP: "RP", QTypeAFSDB: "AFSDB", QTypeX25: "X25", QTypeISDN: "ISDN",
+	QTypeRT: "RT", QTypeNSAP: "NSAP", QTypeNSAPPTR: "NSAP-PTR", QTypeSIG: "SIG",
+	QTypeKEY: "KEY", QTypePX: "PX", QTypeGPOS: "GPOS", QTypeAAAA: "AAAA",
+	QTypeLOC: "LOC", QTypeNXT: "NXT", QTypeEID: "EID", QTypeNIMLOC: "NIMLOC",
+	QTypeSRV: "SRV", QTypeATMA: "ATMA", QTypeNAPTR: "NAPTR", QTypeKX: "KX",
+	QTypeCERT: "CERT", QTypeA6: "A6", QTypeDNAME: "DNAME", QTypeSINK: "SINK",
+	QTypeOPT: "OPT", QTypeAPL: "APL", QTypeDS: "DS", QTypeSSHFP: "SSHFP",
+	QTypeIPSECKEY: "IPSECKEY", QTypeRRSIG: "RRSIG", QTypeNSEC: "NSEC",
+	QTypeDNSKEY: "DNSKEY", QTypeDHCID: "DHCID", QTypeNSEC3: "NSEC3",
+	QTypeNSEC3PARAM: "NSEC3PARAM", QTypeTLSA: "TLSA", QTypeSMIMEA: "SMIMEA",
+	QTypeHIP: "HIP", QTypeNINFO: "NINFO", QTypeRKEY: "RKEY", QTypeTALINK: "TALINK",
+	QTypeCDS: "CDS", QTypeCDNSKEY: "CDNSKEY", QTypeOPENPGPKEY: "OPENPGPKEY",
+	QTypeCSYNC: "CSYNC", QTypeZONEMD: "ZONEMD", QTypeSVCB: "SVCB",
+	QTypeHTTPS: "HTTPS", QTypeDSYNC: "DSYNC", QTypeSPF: "SPF", QTypeUINFO: "UINFO",
+	QTypeUID: "UID", QTypeGID: "GID", QTypeUNSPEC: "UNSPEC", QTypeNID: "NID",
+	QTypeL32: "L32", QTypeL64: "L64", QTypeLP: "LP", QTypeEUI48: "EUI48",
+	QTypeEUI64: "EUI64", QTypeTKEY: "TKEY", QTypeTSIG: "TSIG", QTypeIXFR: "IXFR",
+	QTypeAXFR: "AXFR", QTypeMAILB: "MAILB", QTypeMAILA: "MAILA", QTypeANY: "ANY",
+	QTypeURI: "URI", QTypeCAA: "CAA", QTypeAVC: "AVC", QTypeDOA: "DOA",
+	QTypeAMTRELAY: "AMTRELAY", QTypeRESINFO: "RESINFO", QTypeWALLET: "WALLET",
+	QTypeTA: "TA", QTypeDLV: "DLV",
+}
+
+var qclassNames = map[QClass]string{
+	QClassIN:   "IN",
+	QClassCH:   "CH",
+	QClassHS:   "HS",
+	QClassNONE: "NONE",
+	QClassANY:  "ANY",
+}
+
+var (
+	qtypeByName  = reverseNames(qtypeNames)
+	qclassByName = reverseNames(qclassNames)
+)
+
+func reverseNames[K ~uint8 | ~uint16](names map[K]string) map[string]K {
+	m := make(map[string]K, len(names))
+	for k, v := range names {
+		m[v] = k
+	}
+	return m
+}
+
+func (qt QType) String() string {
+	if name, ok := qtypeNames[qt]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", uint16(qt))
+}
+
+func (qc QClass) String() string {
+	if name, ok := qclassNames[qc]; ok {
+		return name
+	}
+	return fmt.Sprintf("CLASS%d", uint16(qc))
+}
+
+// ParseQType parses a type mnemonic ("HTTPS", case-insensitive) or the
+// generic TYPEnn form from RFC 3597
+func ParseQType(s string) (QType, error) {
+	u := strings.ToUpper(s)
+	if qt, ok := qtypeByName[u]; ok {
+		return qt, nil
+	}
+	if u == "*" {
+		return QTypeANY, nil
+	}
+	n, err := parseGenericNumber(u, "TYPE", 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown type %q", s)
+	}
+	return QType(n), nil
+}
+
+// ParseQClass parses a class mnemonic or the generic CLASSnn form
+func ParseQClass(s string) (QClass, error) {
+	u := strings.ToUpper(s)
+	if qc, ok := qclassByName[u]; ok {
+		return qc, nil
+	}
+	switch u {
+	case "CHAOS":
+		return QClassCH, nil
+	case "HESIOD":
+		return QClassHS, nil
+	case "*":
+		return QClassANY, nil
+	}
+	n, err := parseGenericNumber(u, "CLASS", 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown class %q", s)
+	}
+	return QClass(n), nil
+}
+
+// parseGenericNumber parses strings such as TYPE65 or CLASS3
+func parseGenericNumber(s, prefix string, bits int) (uint64, error) {
+	if !strings.HasPrefix(s, prefix) || len(s) == len(prefix) {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.ParseUint(s[len(prefix):], 10, bits)
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultUpstreamTimeout     = 3 * time.Second
+	DefaultUpstreamRetries     = 1
+	DefaultUpstreamMaxFails    = 3
+	DefaultHealthCheckInterval = 10 * time.Second
+)
+
+// UpstreamPolicy decides the order in which upstreams are tried
+type UpstreamPolicy int
+
+const (
+	PolicyOrdered       UpstreamPolicy = iota // first healthy upstream in the configured order
+	PolicyRoundRobin                          // rotate the starting upstream per query
+	PolicyRandom                              // shuffle per query
+	PolicyLowestLatency                       // lowest smoothed RTT first
+)
+
+var upstreamPolicyNames = map[UpstreamPolicy]string{
+	PolicyOrdered:       "ordered",
+	PolicyRoundRobin:    "round-robin",
+	PolicyRandom:        "random",
+	PolicyLowestLatency: "lowest-latency",
+}
+
+func (p UpstreamPolicy) String() string {
+	if name, ok := upstreamPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("POLICY%d", int(p))
+}
+
+func ParseUpstreamPolicy(s string) (UpstreamPolicy, error) {
+	switch strings.ToLower(s) {
+	case "ordered", "failover":
+		return PolicyOrdered, nil
+	case "round-robin", "roundrobin", "rr":
+		return PolicyRoundRobin, nil
+	case "random":
+		return PolicyRandom, nil
+	case "lowest-latency", "fastest", "srtt":
+		return PolicyLowestLatency, nil
+	}
+	return 0, fmt.Errorf("unknown upstream policy %q", s)
+}
+
+// Upstream is one upstream server together with its health state
+type Upstream struct {
+	Addr    string
+	Timeout time.Duration
+	Retries int // extra attempts after the first one fails
+
+	dot *dotClient // set for DNS-over-TLS upstreams
+	doh *dohClient // set for DNS-over-HTTPS upstreams
+
+	mu    sync.Mutex
+	fails int  // consecutive failures
+	down  bool // set after maxFails consecutive failures
+	srtt  time.Duration
+}
+
+// ParseUpstream parses "[scheme://]host[:port][/path][?option=value&...]".
+// Schemes are udp (the default, port 53, falling back to TCP), tls
+// (DNS-over-TLS, port 853) and https (DNS-over-HTTPS, port 443, path
+// /dns-query). Options are timeout and retries, which otherwise take the
+// given defaults, and for tls and https:
+//
+//	name       authentication name checked against the certificate (default host)
+//	pin        base64 SHA-256 SPKI pin, repeatable
+//	ca         PEM file of CA certificates to trust instead of the system roots
+//
+// and for https only:
+//
+//	method     post (default) or get
+//	bootstrap  plain DNS server used to resolve the endpoint host, repeatable
+//	           (default UpstreamDNS)
+func ParseUpstream(spec string, timeout time.Duration, retries int) (*Upstream, error) {
+	scheme, rest, found := strings.Cut(spec, "://")
+	if !found {
+		scheme, rest = "udp", spec
+	}
+	addr, rawOpts, _ := strings.Cut(rest, "?")
+	if addr == "" {
+		return nil, errors.New("empty upstream address")
+	}
+	var port, path string
+	switch scheme {
+	case "udp", "dns":
+		port = "53"
+	case "tls":
+		port = DefaultDoTPort
+	case "https":
+		port = "443"
+		if i := strings.IndexByte(addr, '/'); i >= 0 {
+			addr, path = addr[:i], addr[i:]
+		} else {
+			path = DefaultDoHPath
+		}
+	default:
+		return nil, fmt.Errorf("upstream %s: unknown scheme %q", spec, scheme)
+	}
+	endpoint := "https://" + addr + path
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	u := &Upstream{Addr: addr, Timeout: timeout, Retries: retries}
+
+	opts, err := url.ParseQuery(rawOpts)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", spec, err)
+	}
+	encrypted := scheme == "tls" || scheme == "https"
+	host, _, _ := net.SplitHostPort(addr)
+	authName, caFile := host, ""
+	usePOST := true
+	var pins, bootstrap []string
+	for k, v := range opts {
+		switch {
+		case k == "timeout":
+			if u.Timeout, err = time.ParseDuration(v[0]); err != nil {
+				return nil, fmt.Errorf("upstream %s: bad timeout: %w", spec, err)
+			}
+		case k == "retries":
+			if u.Retries, err = strconv.Atoi(v[0]); err != nil {
+				return nil, fmt.Errorf("upstream %s: bad retries: %w", spec, err)
+			}
+		case k == "name" && encrypted:
+			authName = v[0]
+		case k == "ca" && encrypted:
+			caFile = v[0]
+		case k == "pin" && encrypted:
+			for _, p := range v {
+				// an unescaped '+' in base64 decodes as a space
+				pins = append(pins, strings.ReplaceAll(p, " ", "+"))
+			}
+		case k == "method" && scheme == "https":
+			switch strings.ToLower(v[0]) {
+			case "post":
+				usePOST = true
+			case "get":
+				usePOST = false
+			default:
+				return nil, fmt.Errorf("upstream %s: bad method %q", spec, v[0])
+			}
+		case k == "bootstrap" && scheme == "https":
+			bootstrap = append(bootstrap, v...)
+		default:
+			return nil, fmt.Errorf("upstream %s: unknown option %q", spec, k)
+		}
+	}
+	if !encrypted {
+		return u, nil
+	}
+
+	config, err := upstreamTLSConfig(authName, caFile, pins)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", spec, err)
+	}
+	if scheme == "tls" {
+		u.dot = newDoTClient(addr, config)
+		return u, nil
+	}
+	if len(bootstrap) == 0 {
+		bootstrap = []string{UpstreamDNS}
+	}
+	var ups []*Upstream
+	for _, b := range bootstrap {
+		bu, err := ParseUpstream(b, u.Timeout, DefaultUpstreamRetries)
+		if err != nil || bu.dot != nil || bu.doh != nil {
+			return nil, fmt.Errorf("upstream %s: bad bootstrap server %q", spec, b)
+		}
+		ups = append(ups, bu)
+	}
+	u.doh = newDoHClient(endpoint, usePOST, config, NewUpstreamPool(ups, PolicyOrdered))
+	return u, nil
+}
+
+func (u *Upstream) String() string {
+	switch {
+	case u.dot != nil:
+		return "tls://" + u.Addr
+	case u.doh != nil:
+		return u.doh.url
+	}
+	return u.Addr
+}
+
+// healthy reports whether the upstream is currently considered up
+func (u *Upstream) healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.down
+}
+
+func (u *Upstream) rtt() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.srtt
+}
+
+// recordSuccess folds rtt into the smoothed RTT (RFC 6298 style, 1/8
+// weight) and clears the failure count
+func (u *Upstream) recordSuccess(rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.srtt == 0 {
+		u.srtt = rtt
+	} else {
+		u.srtt += (rtt - u.srtt) / 8
+	}
+	u.fails = 0
+	if u.down {
+		u.down = false
+		log.Printf("✅ Upstream %s is back up", u.Addr)
+	}
+}
+
+// recordFailure penalizes the smoothed RTT with the timeout and marks the
+// upstream down after maxFails consecutive failures
+func (u *Upstream) recordFailure(maxFails int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.srtt += (u.Timeout - u.srtt) / 8
+	u.fails++
+	if maxFails > 0 && u.fails >= maxFails && !u.down {
+		u.down = true
+		log.Printf("❌ Upstream %s marked down after %d consecutive failures", u.Addr, u.fails)
+	}
+}
+
+// exchange sends query over the upstream's transport and returns the
+// validated reply. Plain DNS uses a fresh random ID and retries over TCP
+// when the UDP answer is truncated. With exactCase the question name in the
+// reply must match byte for byte (0x20).
+func (u *Upstream) exchange(query *DnsPacket, exactCase bool) (*DnsPacket, error) {
+	switch {
+	case u.dot != nil:
+		return u.dot.exchange(query, exactCase, u.Timeout)
+	case u.doh != nil:
+		return u.doh.exchange(query, exactCase, u.Timeout)
+	}
+	query.Header.ID = randomID()
+	raw, err := query.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.exchangeUDP(query, raw, exactCase)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Truncated {
+		// answer didn't fit in a datagram, ask again over TCP (RFC 7766)
+		log.Printf("✂️ Truncated response from %s, retrying over TCP", u.Addr)
+		return u.exchangeTCP(query, raw, exactCase)
+	}
+	return resp, nil
+}
+
+// exchangeUDP sends a query datagram upstream from a fresh socket on a
+// random port and waits for a reply that matches it. Datagrams from other
+// addresses, unparsable ones and ones for a different query are dropped
+// while waiting continues until the deadline (RFC 5452 9).
+func (u *Upstream) exchangeUDP(query *DnsPacket, raw []byte, exactCase bool) (*DnsPacket, error) {
+	raddr, err := net.ResolveUDPAddr("udp", u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenRandomPort(raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(u.Timeout))
+
+	if _, err := conn.WriteToUDP(raw, raddr); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, query.Edns.payloadSize())
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+		if !from.IP.Equal(raddr.IP) || from.Port != raddr.Port {
+			log.Printf("⚠️ Discarded datagram from %s while waiting for %s", from, u.Addr)
+			continue
+		}
+		resp, err := FromBytes(buf[:n])
+		if err != nil {
+			log.Printf("⚠️ Discarded unparsable response from %s: %v", u.Addr, err)
+			continue
+		}
+		if err := checkResponse(query, resp, exactCase); err != nil {
+			log.Printf("⚠️ Discarded mismatched response from %s: %v", u.Addr, err)
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// listenRandomPort opens an unconnected UDP socket on a random unprivileged
+// port, letting the kernel choose if the picked ports are taken
+func listenRandomPort(raddr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp4"
+	if raddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	for range 3 {
+		port := 1024 + int(randomID())%(0x10000-1024)
+		conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return net.ListenUDP(network, nil)
+}
+
+// exchangeTCP sends a length-prefixed query upstream over TCP
+func (u *Upstream) exchangeTCP(query *DnsPacket, raw []byte, exactCase bool) (*DnsPacket, error) {
+	conn, err := net.DialTimeout("tcp", u.Addr, u.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(u.Timeout))
+
+	if err := writeTCPMessage(conn, raw); err != nil {
+		return nil, err
+	}
+	data, err := readTCPMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := parseUpstream(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(query, resp, exactCase); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func parseUpstream(data []byte) (*DnsPacket, error) {
+	upPkt, err := FromBytes(data)
+	if err != nil {
+		log.Printf("warning: failed to parse upstream response: %v", err)
+		return nil, err
+	}
+	return upPkt, nil
+}
+
+// UpstreamPool is a set of upstreams queried according to a policy, with
+// failover to the next upstream when one fails
+type UpstreamPool struct {
+	upstreams []*Upstream
+	policy    UpstreamPolicy
+	maxFails  int // consecutive failures before an upstream is marked down
+	next      atomic.Uint32
+
+	stopProbes chan struct{}
+}
+
+func NewUpstreamPool(upstreams []*Upstream, policy UpstreamPolicy) *UpstreamPool {
+	return &UpstreamPool{
+		upstreams: upstreams,
+		policy:    policy,
+		maxFails:  DefaultUpstreamMaxFails,
+	}
+}
+
+func (p *UpstreamPool) String() string {
+	addrs := make([]string, len(p.upstreams))
+	for i, u := range p.upstreams {
+		addrs[i] = u.String()
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(addrs, ", "), p.policy)
+}
+
+// order returns the upstreams in the order to try them: healthy ones as
+// ranked by the policy, then the ones marked down as a last resort
+func (p *UpstreamPool) order() []*Upstream {
+	ranked := make([]*Upstream, len(p.upstreams))
+	copy(ranked, p.upstreams)
+	switch p.policy {
+	case PolicyRoundRobin:
+		n := len(ranked)
+		start := int(p.next.Add(1)-1) % n
+		ranked = append(ranked[start:n:n], ranked[:start]...)
+	case PolicyRandom:
+		rand.Shuffle(len(ranked), func(i, j int) { ranked[i], ranked[j] = ranked[j], ranked[i] })
+	case PolicyLowestLatency:
+		sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].rtt() < ranked[j].rtt() })
+	}
+
+	healthy := make([]*Upstream, 0, len(ranked))
+	var down []*Upstream
+	for _, u := range ranked {
+		if u.healthy() {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// Exchange sends query to the pool's upstreams until one answers. SERVFAIL
+// and REFUSED count as failed attempts, like timeouts. Every attempt gets a
+// new random ID.
+func (p *UpstreamPool) Exchange(query *DnsPacket, exactCase bool) (*DnsPacket, error) {
+	if len(p.upstreams) == 0 {
+		return nil, errors.New("no upstreams configured")
+	}
+
+	var lastErr error
+	for _, u := range p.order() {
+		for attempt := 0; attempt <= u.Retries; attempt++ {
+			start := time.Now()
+			resp, err := u.exchange(query, exactCase)
+			if err == nil {
+				err = rcodeFailure(u, resp)
+			}
+			if err == nil {
+				u.recordSuccess(time.Since(start))
+				return resp, nil
+			}
+			u.recordFailure(p.maxFails)
+			log.Printf("❌ Upstream %s failed (attempt %d/%d): %v", u.Addr, attempt+1, u.Retries+1, err)
+			lastErr = err
+		}
+	}
+	return nil, fmt.Errorf("all upstreams failed: %w", lastErr)
+}
+
+// StartHealthChecks probes upstreams marked down every interval and brings
+// them back once they answer again. An interval of zero or less disables
+// probing; upstreams marked down are then only retried as a last resort.
+func (p *UpstreamPool) StartHealthChecks(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	p.stopProbes = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.probeDown()
+			case <-stop:
+				return
+			}
+		}
+	}(p.stopProbes)
+}
+
+// Close stops the health checks and closes persistent connections
+func (p *UpstreamPool) Close() {
+	if p.stopProbes != nil {
+		close(p.stopProbes)
+		p.stopProbes = nil
+	}
+	for _, u := range p.upstreams {
+		if u.dot != nil {
+			u.dot.close()
+		}
+		if u.doh != nil {
+			u.doh.close()
+		}
+	}
+}
+
+// probeDown asks every upstream marked down for the root NS set
+func (p *UpstreamPool) probeDown() {
+	probe := NewDnsPacket()
+	probe.Header.RecursionDesired = true
+	probe.Questions = append(probe.Questions, &DnsQuestion{Name: "", QType: QTypeNS, QClass: QClassIN})
+	for _, u := range p.upstreams {
+		if u.healthy() {
+			continue
+		}
+		start := time.Now()
+		resp, err := u.exchange(probe, false)
+		if err == nil && rcodeFailure(u, resp) == nil {
+			u.recordSuccess(time.Since(start))
+		}
+	}
+}
+
+// rcodeFailure returns an error for replies that mean the upstream couldn't
+// or wouldn't answer, so they count against it like a timeout
+func rcodeFailure(u *Upstream, resp *DnsPacket) error {
+	switch resp.Header.RESCODE {
+	case SERVFAIL, REFUSED:
+		return fmt.Errorf("%s answered %s", u.Addr, resp.Header.RESCODE)
+	}
+	return nil
+}
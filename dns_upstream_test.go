@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServer is a DNS server on a loopback address that answers every UDP
+// query with whatever handle returns for it
+type fakeServer struct {
+	addr    string
+	queries atomic.Int32
+}
+
+// startFakeServer listens on addr ("127.0.0.1:0" for a free port) until the
+// test ends. Each query is handled in its own goroutine, so a slow answer
+// doesn't hold up the others. A nil reply from handle drops the query.
+func startFakeServer(t *testing.T, addr string, handle func(q *DnsPacket) *DnsPacket) *fakeServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("listen %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &fakeServer{addr: conn.LocalAddr().String()}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			s.queries.Add(1)
+			q, err := FromBytes(buf[:n])
+			if err != nil {
+				continue
+			}
+			go func() {
+				resp := handle(q)
+				if resp == nil {
+					return
+				}
+				if data, err := resp.ToBytes(); err == nil {
+					conn.WriteTo(data, from)
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+// reply returns a response to q with the given rcode and answers
+func reply(q *DnsPacket, rcode RCode, answers ...*DnsRecord) *DnsPacket {
+	resp := NewDnsPacket()
+	resp.Header.ID = q.Header.ID
+	resp.Header.Response = true
+	resp.Header.RESCODE = rcode
+	resp.Questions = q.Questions
+	resp.Answers = append(resp.Answers, answers...)
+	return resp
+}
+
+func mustA(t *testing.T, name, ip string) *DnsRecord {
+	t.Helper()
+	rec, err := NewARecord(name, ip, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func aQuery(name string) *DnsPacket {
+	q := NewDnsPacket()
+	q.Header.RecursionDesired = true
+	q.Questions = append(q.Questions, &DnsQuestion{Name: name, QType: QTypeA, QClass: QClassIN})
+	return q
+}
+
+func TestPoolFailsOverOnRefused(t *testing.T) {
+	refusing := startFakeServer(t, "127.0.0.1:0", func(q *DnsPacket) *DnsPacket {
+		return reply(q, REFUSED)
+	})
+	good := startFakeServer(t, "127.0.0.1:0", func(q *DnsPacket) *DnsPacket {
+		return reply(q, NOERROR, mustA(t, q.Questions[0].Name, "192.0.2.1"))
+	})
+	bad := &Upstream{Addr: refusing.addr, Timeout: time.Second}
+	pool := NewUpstreamPool([]*Upstream{bad, {Addr: good.addr, Timeout: time.Second}}, PolicyOrdered)
+	pool.maxFails = 2
+
+	for range 2 {
+		resp, err := pool.Exchange(aQuery("example.com"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.RESCODE != NOERROR || len(resp.Answers) != 1 {
+			t.Fatalf("got %s with %d answers, want NOERROR with 1", resp.Header.RESCODE, len(resp.Answers))
+		}
+	}
+	if bad.healthy() {
+		t.Fatal("upstream answering REFUSED was not marked down")
+	}
+}
+
+func TestPoolFailsWhenAllServFail(t *testing.T) {
+	s := startFakeServer(t, "127.0.0.1:0", func(q *DnsPacket) *DnsPacket {
+		return reply(q, SERVFAIL)
+	})
+	pool := NewUpstreamPool([]*Upstream{{Addr: s.addr, Timeout: time.Second}}, PolicyOrdered)
+	_, err := pool.Exchange(aQuery("example.com"), false)
+	if err == nil || !strings.Contains(err.Error(), "SERVFAIL") {
+		t.Fatalf("got error %v, want a SERVFAIL failure", err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// randomID returns an unpredictable query ID (RFC 5452 4.3)
+func randomID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// randomizeCase flips the case of each letter in name at random (DNS 0x20,
+// draft-vixie-dnsext-dns0x20). Servers echo the question verbatim, so a
+// spoofed answer also has to guess the case pattern.
+func randomizeCase(name string) string {
+	bits := make([]byte, (len(name)+7)/8)
+	rand.Read(bits)
+	b := []byte(name)
+	for i, c := range b {
+		if bits[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// checkResponse verifies that resp answers query: same ID, QR set and the
+// same question (RFC 5452 9.1). With exactCase the name must match byte
+// for byte, as required when 0x20 randomization is in use.
+func checkResponse(query, resp *DnsPacket, exactCase bool) error {
+	if resp.Header.ID != query.Header.ID {
+		return fmt.Errorf("ID mismatch: got %d, want %d", resp.Header.ID, query.Header.ID)
+	}
+	if !resp.Header.Response {
+		return errors.New("not a response")
+	}
+	if len(resp.Questions) != len(query.Questions) {
+		return fmt.Errorf("question count mismatch: got %d, want %d", len(resp.Questions), len(query.Questions))
+	}
+	for i, q := range query.Questions {
+		rq := resp.Questions[i]
+		sameName := rq.Name == q.Name || !exactCase && strings.EqualFold(rq.Name, q.Name)
+		if !sameName || rq.QType != q.QType || rq.QClass != q.QClass {
+			return fmt.Errorf("question mismatch: got %s %s %s, want %s %s %s",
+				fqdn(rq.Name), rq.QClass, rq.QType, fqdn(q.Name), q.QClass, q.QType)
+		}
+	}
+	return nil
+}
+
+// restoreCase undoes 0x20 randomization in a validated response, putting
+// back the name as originally asked wherever the randomized one appears
+func restoreCase(resp *DnsPacket, sent, original string) {
+	if sent == original {
+		return
+	}
+	for _, q := range resp.Questions {
+		if q.Name == sent {
+			q.Name = original
+		}
+	}
+	for _, section := range [][]*DnsRecord{resp.Answers, resp.Authorities, resp.Resources} {
+		for _, r := range section {
+			if strings.EqualFold(r.Name, original) {
+				r.Name = original
+			}
+		}
+	}
+}
+
+// scrubResponse drops records a server has no business sending before the
+// response is used or cached. zone is the server's bailiwick, "" when it
+// is a recursive upstream trusted for every name. It keeps:
+//
+//   - answers on the CNAME chain from qname, inside zone
+//   - authority records inside zone owned by an ancestor of a chain name
+//     (the SOA of a negative answer, the NS set of a referral), and DNSSEC
+//     denial records inside zone
+//   - additional records inside zone for names the kept records point to
+//     (glue, MX/SRV targets)
+func scrubResponse(resp *DnsPacket, qname string, qtype QType, zone string) {
+	chain, _ := followCNAMEs(resp.Answers, qname, qtype)
+	names := []string{normalizeName(qname)}
+	answers := make([]*DnsRecord, 0, len(chain))
+	for _, r := range chain {
+		if !inBailiwick(r.Name, zone) {
+			break
+		}
+		answers = append(answers, r)
+		if c, ok := r.RData.(*RDataCNAME); ok {
+			names = append(names, normalizeName(c.Target))
+		}
+	}
+
+	authorities := make([]*DnsRecord, 0, len(resp.Authorities))
+	for _, r := range resp.Authorities {
+		if !inBailiwick(r.Name, zone) {
+			continue
+		}
+		switch r.Type {
+		case QTypeNSEC, QTypeNSEC3, QTypeRRSIG:
+			// denial of existence proofs are owned by neighbouring names
+			authorities = append(authorities, r)
+			continue
+		}
+		for _, n := range names {
+			if inBailiwick(n, r.Name) {
+				authorities = append(authorities, r)
+				break
+			}
+		}
+	}
+
+	targets := map[string]bool{}
+	for _, section := range [][]*DnsRecord{answers, authorities} {
+		for _, r := range section {
+			if t := rdataTarget(r.RData); t != "" {
+				targets[normalizeName(t)] = true
+			}
+		}
+	}
+	resources := make([]*DnsRecord, 0, len(resp.Resources))
+	for _, r := range resp.Resources {
+		if targets[normalizeName(r.Name)] && inBailiwick(r.Name, zone) {
+			resources = append(resources, r)
+		}
+	}
+
+	if dropped := len(resp.Answers) + len(resp.Authorities) + len(resp.Resources) -
+		len(answers) - len(authorities) - len(resources); dropped > 0 {
+		log.Printf("🧹 Dropped %d unrelated or out-of-bailiwick records from answer for %s (zone %s)", dropped, fqdn(qname), fqdn(zone))
+	}
+	resp.Answers, resp.Authorities, resp.Resources = answers, authorities, resources
+}
+
+// rdataTarget returns the host name an RDATA refers to, if any
+func rdataTarget(d RData) string {
+	switch d := d.(type) {
+	case *RDataNS:
+		return d.Host
+	case *RDataCNAME:
+		return d.Target
+	case *RDataMX:
+		return d.Exchange
+	case *RDataSRV:
+		return d.Target
+	}
+	return ""
+}
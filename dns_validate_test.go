@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+// emptyCNAMEResponse returns a response for foo/A whose answer is a CNAME
+// with zero-length RDATA
+func emptyCNAMEResponse() *DnsPacket {
+	p := NewDnsPacket()
+	p.Header.Response = true
+	p.Questions = append(p.Questions, &DnsQuestion{Name: "foo", QType: QTypeA, QClass: QClassIN})
+	p.Answers = append(p.Answers,
+		&DnsRecord{Name: "foo", Type: QTypeCNAME, Class: QClassIN, TTL: 60, RData: &RDataOpaque{Data: []byte{}}},
+		&DnsRecord{Name: "bar", Type: QTypeA, Class: QClassIN, TTL: 60, RData: &RDataA{IP: []byte{192, 0, 2, 1}}},
+	)
+	return p
+}
+
+func TestEmptyCNAMEIsRejected(t *testing.T) {
+	data, err := emptyCNAMEResponse().ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FromBytes(data); err == nil {
+		t.Fatal("FromBytes accepted a CNAME with empty RDATA")
+	}
+}
+
+func TestScrubResponseSkipsMalformedCNAME(t *testing.T) {
+	p := emptyCNAMEResponse()
+	scrubResponse(p, "foo", QTypeA, "")
+	if len(p.Answers) != 0 {
+		t.Fatalf("kept %d answers, want 0", len(p.Answers))
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// maxZoneCNAMEs bounds the in-zone CNAME chain followed for one answer
+const maxZoneCNAMEs = 8
+
+// Zone holds the records of one zone we are authoritative for, in a tree of
+// labels rooted at the apex. Names at or below a child NS record are
+// delegated; records there only serve as glue.
+type Zone struct {
+	origin  string // lower-cased apex without trailing dot
+	class   QClass
+	soa     *DnsRecord
+	root    *zoneNode
+	records int
+}
+
+type zoneNode struct {
+	children map[string]*zoneNode // keyed by lower-cased label
+	rrsets   map[QType][]*DnsRecord
+}
+
+// zoneAnswer is what a zone has to say about a question: an authoritative
+// answer, NXDOMAIN or NODATA with the SOA, or a referral to a child zone
+type zoneAnswer struct {
+	answers       []*DnsRecord
+	authorities   []*DnsRecord
+	additionals   []*DnsRecord
+	rcode         RCode
+	authoritative bool
+}
+
+// NewZone builds the zone origin from records, which must all lie inside
+// it. The zone needs exactly one SOA, at the apex, and a name holding a
+// CNAME may not hold other data (RFC 1034 3.6.2).
+func NewZone(origin string, records []*DnsRecord) (*Zone, error) {
+	z := &Zone{origin: normalizeName(origin), root: newZoneNode()}
+	for _, r := range records {
+		if !inBailiwick(r.Name, z.origin) {
+			return nil, fmt.Errorf("zone %s: %s is outside the zone", fqdn(z.origin), fqdn(r.Name))
+		}
+		if r.Type == QTypeSOA {
+			if normalizeName(r.Name) != z.origin {
+				return nil, fmt.Errorf("zone %s: SOA at %s instead of the apex", fqdn(z.origin), fqdn(r.Name))
+			}
+			if z.soa != nil {
+				return nil, fmt.Errorf("zone %s: more than one SOA", fqdn(z.origin))
+			}
+			z.soa, z.class = r, r.Class
+		}
+		z.insert(r)
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("zone %s: no SOA record", fqdn(z.origin))
+	}
+	if err := z.root.check(z.origin); err != nil {
+		return nil, fmt.Errorf("zone %s: %w", fqdn(z.origin), err)
+	}
+	return z, nil
+}
+
+// LoadZone parses the master file at path and builds the zone origin
+func LoadZone(origin, path string) (*Zone, error) {
+	records, err := ParseZoneFile(path, origin)
+	if err != nil {
+		return nil, err
+	}
+	return NewZone(origin, records)
+}
+
+func newZoneNode() *zoneNode {
+	return &zoneNode{children: make(map[string]*zoneNode), rrsets: make(map[QType][]*DnsRecord)}
+}
+
+// insert adds r, creating the nodes on its path; duplicate records are
+// dropped
+func (z *Zone) insert(r *DnsRecord) {
+	n := z.root
+	for _, label := range z.labels(r.Name) {
+		child, ok := n.children[label]
+		if !ok {
+			child = newZoneNode()
+			n.children[label] = child
+		}
+		n = child
+	}
+	for _, old := range n.rrsets[r.Type] {
+		if old.Class == r.Class && old.RData.String() == r.RData.String() {
+			return
+		}
+	}
+	n.rrsets[r.Type] = append(n.rrsets[r.Type], r)
+	z.records++
+}
+
+// check rejects CNAMEs sharing a name with other data below n
+func (n *zoneNode) check(name string) error {
+	if cnames := n.rrsets[QTypeCNAME]; len(cnames) > 0 {
+		if len(cnames) > 1 {
+			return fmt.Errorf("%s has more than one CNAME", fqdn(name))
+		}
+		for t := range n.rrsets {
+			// DNSSEC allows RRSIG and NSEC beside a CNAME (RFC 4035 2.5)
+			if t != QTypeCNAME && t != QTypeRRSIG && t != QTypeNSEC {
+				return fmt.Errorf("%s has a CNAME and %s records", fqdn(name), t)
+			}
+		}
+	}
+	for label, child := range n.children {
+		if err := child.check(joinName(label, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labels returns the labels of name below the apex, apex side first
+func (z *Zone) labels(name string) []string {
+	name = normalizeName(name)
+	rel := strings.TrimSuffix(strings.TrimSuffix(name, z.origin), ".")
+	if rel == "" {
+		return nil
+	}
+	labels := strings.Split(rel, ".")
+	slices.Reverse(labels)
+	return labels
+}
+
+// find walks down to name. It stops at the first zone cut on the way,
+// which is returned instead of the node; at name itself a cut only counts
+// when the question isn't for the parent side of the delegation (DS).
+func (z *Zone) find(name string, qtype QType) (node, cut *zoneNode) {
+	n := z.root
+	labels := z.labels(name)
+	for i, label := range labels {
+		child, ok := n.children[label]
+		if !ok {
+			return nil, nil
+		}
+		n = child
+		if len(n.rrsets[QTypeNS]) > 0 && (i < len(labels)-1 || qtype != QTypeDS) {
+			return nil, n
+		}
+	}
+	return n, nil
+}
+
+// lookup returns the records of the given type at name, ignoring zone cuts
+// so that glue below them is found too
+func (z *Zone) lookup(name string, qtype QType) []*DnsRecord {
+	n := z.root
+	for _, label := range z.labels(name) {
+		if n = n.children[label]; n == nil {
+			return nil
+		}
+	}
+	return n.rrsets[qtype]
+}
+
+// Answer resolves a question from the zone data alone. CNAMEs are followed
+// while their targets stay inside the zone; the client resolves the rest.
+func (z *Zone) Answer(name string, qtype QType) *zoneAnswer {
+	ans := &zoneAnswer{authoritative: true}
+	seen := make(map[string]bool)
+	for {
+		node, cut := z.find(name, qtype)
+		if cut != nil {
+			// referral: only a CNAME leading here is our own data
+			ans.authoritative = len(ans.answers) > 0
+			ans.authorities = append(ans.authorities, cut.rrsets[QTypeNS]...)
+			ans.additionals = z.addresses(cut.rrsets[QTypeNS])
+			return ans
+		}
+		if node == nil {
+			ans.rcode = NXDOMAIN
+			ans.authorities = z.negativeSOA()
+			return ans
+		}
+
+		if cnames := node.rrsets[QTypeCNAME]; len(cnames) > 0 && qtype != QTypeCNAME && qtype != QTypeANY {
+			ans.answers = append(ans.answers, cnames...)
+			seen[normalizeName(name)] = true
+			cname, ok := cnames[0].RData.(*RDataCNAME)
+			if !ok {
+				return ans
+			}
+			target := normalizeName(cname.Target)
+			if seen[target] || len(seen) > maxZoneCNAMEs || !inBailiwick(target, z.origin) {
+				return ans
+			}
+			name = target
+			continue
+		}
+
+		var records []*DnsRecord
+		if qtype == QTypeANY {
+			types := make([]QType, 0, len(node.rrsets))
+			for t := range node.rrsets {
+				types = append(types, t)
+			}
+			slices.Sort(types)
+			for _, t := range types {
+				records = append(records, node.rrsets[t]...)
+			}
+		} else {
+			records = node.rrsets[qtype]
+		}
+		if len(records) == 0 {
+			ans.authorities = z.negativeSOA()
+			return ans
+		}
+		ans.answers = append(ans.answers, records...)
+		ans.additionals = z.addresses(records)
+		return ans
+	}
+}
+
+// addresses returns the in-zone A and AAAA records for the hosts named by
+// NS, MX and SRV records: glue for referrals, additional data otherwise
+func (z *Zone) addresses(records []*DnsRecord) []*DnsRecord {
+	var out []*DnsRecord
+	seen := make(map[string]bool)
+	for _, r := range records {
+		var host string
+		switch rd := r.RData.(type) {
+		case *RDataNS:
+			host = rd.Host
+		case *RDataMX:
+			host = rd.Exchange
+		case *RDataSRV:
+			host = rd.Target
+		default:
+			continue
+		}
+		host = normalizeName(host)
+		if seen[host] || !inBailiwick(host, z.origin) {
+			continue
+		}
+		seen[host] = true
+		out = append(out, z.lookup(host, QTypeA)...)
+		out = append(out, z.lookup(host, QTypeAAAA)...)
+	}
+	return out
+}
+
+// negativeSOA is the SOA for NXDOMAIN and NODATA answers, its TTL capped
+// at the MINIMUM field (RFC 2308 3)
+func (z *Zone) negativeSOA() []*DnsRecord {
+	soa := *z.soa
+	if rd, ok := soa.RData.(*RDataSOA); ok && rd.Minimum < soa.TTL {
+		soa.TTL = rd.Minimum
+	}
+	return []*DnsRecord{&soa}
+}
+
+func (z *Zone) String() string {
+	return fmt.Sprintf("%s (%d records)", fqdn(z.origin), z.records)
+}
+
+// ZoneTable holds the zones served authoritatively. A question belongs to
+// the zone with the longest matching origin.
+type ZoneTable struct {
+	zones map[string]*Zone
+}
+
+func NewZoneTable() *ZoneTable {
+	return &ZoneTable{zones: make(map[string]*Zone)}
+}
+
+// Add serves z, replacing any zone with the same origin
+func (t *ZoneTable) Add(z *Zone) {
+	t.zones[z.origin] = z
+}
+
+// Lookup returns the zone containing name
+func (t *ZoneTable) Lookup(name string) (*Zone, bool) {
+	if t == nil || len(t.zones) == 0 {
+		return nil, false
+	}
+	name = normalizeName(name)
+	for {
+		if z, ok := t.zones[name]; ok {
+			return z, true
+		}
+		if name == "" {
+			return nil, false
+		}
+		name = parentName(name)
+	}
+}
+
+// ParseZoneSpec splits "origin=path" from the -zone flag
+func ParseZoneSpec(spec string) (string, string, error) {
+	origin, path, ok := strings.Cut(spec, "=")
+	if !ok || origin == "" || path == "" {
+		return "", "", fmt.Errorf("zone %q: want origin=path", spec)
+	}
+	return origin, path, nil
+}
+
+// joinName prefixes name with label
+func joinName(label, name string) string {
+	if name == "" {
+		return label
+	}
+	return label + "." + name
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testZoneFile = `$ORIGIN example.com.
+$TTL 1h
+@	IN SOA ns1 hostmaster (
+		2024010101 ; serial
+		7200       ; refresh
+		3600       ; retry
+		1209600    ; expire
+		300 )      ; minimum
+	IN NS ns1
+	IN NS ns2.example.net.
+ns1	IN A 192.0.2.1
+www	300 IN A 192.0.2.10
+	IN AAAA 2001:db8::10 ; the owner carries over
+alias	IN CNAME www
+chain	IN CNAME alias
+away	IN CNAME www.example.net.
+mail	IN MX 10 mx
+mx	IN A 192.0.2.25
+txt	IN TXT "hello \"world\"" "semi;colon" \065\066C
+\097lpha IN A 192.0.2.26
+
+$ORIGIN sub.example.com.
+host	IN A 192.0.2.30
+
+$ORIGIN example.com.
+$INCLUDE included.zone inc.example.com.
+after	IN A 192.0.2.40
+
+child	IN NS ns.child
+ns.child IN A 192.0.2.53
+child	IN DS \# 5 3039080201
+`
+
+// writeZoneFiles writes name → contents into a fresh directory and
+// returns the path of the first name given
+func writeZoneFiles(t *testing.T, files ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for i := 0; i < len(files); i += 2 {
+		if err := os.WriteFile(filepath.Join(dir, files[i]), []byte(files[i+1]), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, files[0])
+}
+
+func loadTestZone(t *testing.T) *Zone {
+	t.Helper()
+	path := writeZoneFiles(t,
+		"example.com.zone", testZoneFile,
+		"included.zone", "www IN A 192.0.2.50\n")
+	z, err := LoadZone("example.com", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestZoneFileParsing(t *testing.T) {
+	z := loadTestZone(t)
+	tests := []struct {
+		name  string
+		qtype QType
+		want  string // RData of the single answer
+		ttl   uint32
+	}{
+		{"example.com", QTypeSOA, "ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300", 3600},
+		{"www.example.com", QTypeA, "192.0.2.10", 300},
+		{"www.example.com", QTypeAAAA, "2001:db8::10", 3600},
+		{"txt.example.com", QTypeTXT, `"hello \"world\"" "semi;colon" "ABC"`, 3600},
+		{"alpha.example.com", QTypeA, "192.0.2.26", 3600},
+		{"host.sub.example.com", QTypeA, "192.0.2.30", 3600},
+		{"www.inc.example.com", QTypeA, "192.0.2.50", 3600},
+		{"after.example.com", QTypeA, "192.0.2.40", 3600},
+	}
+	for _, tt := range tests {
+		ans := z.Answer(tt.name, tt.qtype)
+		if ans.rcode != NOERROR || len(ans.answers) != 1 {
+			t.Errorf("%s %s: got %s with %d answers", tt.name, tt.qtype, ans.rcode, len(ans.answers))
+			continue
+		}
+		if got := ans.answers[0].RData.String(); got != tt.want || ans.answers[0].TTL != tt.ttl {
+			t.Errorf("%s %s: got %q TTL %d, want %q TTL %d", tt.name, tt.qtype, got, ans.answers[0].TTL, tt.want, tt.ttl)
+		}
+	}
+}
+
+func TestZoneAnswers(t *testing.T) {
+	z := loadTestZone(t)
+	tests := []struct {
+		desc          string
+		name          string
+		qtype         QType
+		rcode         RCode
+		authoritative bool
+		answers       []QType
+		authorities   []QType
+		additionals   int
+	}{
+		{"answer", "www.example.com", QTypeA, NOERROR, true, []QType{QTypeA}, nil, 0},
+		{"additional data", "mail.example.com", QTypeMX, NOERROR, true, []QType{QTypeMX}, nil, 1},
+		{"NXDOMAIN", "nope.example.com", QTypeA, NXDOMAIN, true, nil, []QType{QTypeSOA}, 0},
+		{"NODATA", "www.example.com", QTypeMX, NOERROR, true, nil, []QType{QTypeSOA}, 0},
+		{"empty non-terminal", "sub.example.com", QTypeA, NOERROR, true, nil, []QType{QTypeSOA}, 0},
+		{"referral", "www.child.example.com", QTypeA, NOERROR, false, nil, []QType{QTypeNS}, 1},
+		{"referral at the cut", "child.example.com", QTypeA, NOERROR, false, nil, []QType{QTypeNS}, 1},
+		{"DS at the cut", "child.example.com", QTypeDS, NOERROR, true, []QType{QTypeDS}, nil, 0},
+		{"CNAME inside the zone", "chain.example.com", QTypeA, NOERROR, true, []QType{QTypeCNAME, QTypeCNAME, QTypeA}, nil, 0},
+		{"CNAME out of the zone", "away.example.com", QTypeA, NOERROR, true, []QType{QTypeCNAME}, nil, 0},
+		{"CNAME asked for", "alias.example.com", QTypeCNAME, NOERROR, true, []QType{QTypeCNAME}, nil, 0},
+	}
+	types := func(records []*DnsRecord) []QType {
+		var out []QType
+		for _, r := range records {
+			out = append(out, r.Type)
+		}
+		return out
+	}
+	for _, tt := range tests {
+		ans := z.Answer(tt.name, tt.qtype)
+		if ans.rcode != tt.rcode || ans.authoritative != tt.authoritative {
+			t.Errorf("%s: got %s AA=%v, want %s AA=%v", tt.desc, ans.rcode, ans.authoritative, tt.rcode, tt.authoritative)
+		}
+		if got := types(ans.answers); !slices.Equal(got, tt.answers) {
+			t.Errorf("%s: answers %v, want %v", tt.desc, got, tt.answers)
+		}
+		if got := types(ans.authorities); !slices.Equal(got, tt.authorities) {
+			t.Errorf("%s: authorities %v, want %v", tt.desc, got, tt.authorities)
+		}
+		if len(ans.additionals) != tt.additionals {
+			t.Errorf("%s: %d additionals, want %d", tt.desc, len(ans.additionals), tt.additionals)
+		}
+		// negative answers carry the SOA with its TTL capped by MINIMUM
+		for _, r := range ans.authorities {
+			if r.Type == QTypeSOA && r.TTL != 300 {
+				t.Errorf("%s: SOA TTL %d, want the MINIMUM of 300", tt.desc, r.TTL)
+			}
+		}
+	}
+}
+
+func TestZoneIncludeDepthLimit(t *testing.T) {
+	path := writeZoneFiles(t, "loop.zone", "$INCLUDE loop.zone\n")
+	_, err := ParseZoneFile(path, "example.com")
+	if err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Fatalf("got error %v, want the $INCLUDE depth limit", err)
+	}
+}
+
+func TestZoneRejectsBadData(t *testing.T) {
+	const soa = "@ 3600 IN SOA ns1 hostmaster 1 7200 3600 1209600 300\n"
+	tests := []struct {
+		desc, data, want string
+	}{
+		{"CNAME beside other data", soa + "www IN CNAME other\nwww IN A 192.0.2.1\n", "has a CNAME and A records"},
+		{"two CNAMEs", soa + "www IN CNAME a\nwww IN CNAME b\n", "more than one CNAME"},
+		{"two SOAs", soa + "@ IN SOA ns2 hostmaster 2 7200 3600 1209600 300\n", "more than one SOA"},
+		{"no SOA", "www 3600 IN A 192.0.2.1\n", "no SOA"},
+		{"SOA below the apex", soa + "sub IN SOA ns1 hostmaster 1 7200 3600 1209600 300\n", "instead of the apex"},
+		{"outside the zone", soa + "www.example.net. IN A 192.0.2.1\n", "outside zone"},
+		{"unbalanced parentheses", "@ 3600 IN SOA ns1 hostmaster ( 1 7200\n", "unbalanced"},
+		{"unterminated quote", soa + "txt IN TXT \"open\n", "unterminated"},
+	}
+	for _, tt := range tests {
+		_, err := LoadZone("example.com", writeZoneFiles(t, "bad.zone", tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one mentioning %q", tt.desc, err, tt.want)
+		}
+	}
+}
+
+func TestZoneTableLongestMatch(t *testing.T) {
+	parent := loadTestZone(t)
+	child, err := NewZone("child.example.com", []*DnsRecord{{Name: "child.example.com", Type: QTypeSOA, Class: QClassIN, TTL: 3600,
+		RData: &RDataSOA{MName: "ns.child.example.com", RName: "hostmaster.example.com", Serial: 1, Minimum: 60}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := NewZoneTable()
+	table.Add(parent)
+	table.Add(child)
+
+	for name, want := range map[string]*Zone{
+		"example.com.":          parent,
+		"WWW.Example.COM":       parent,
+		"www.child.example.com": child,
+		"notchild.example.com":  parent,
+	} {
+		if z, ok := table.Lookup(name); !ok || z != want {
+			t.Errorf("%s: got zone %v, want %v", name, z, want)
+		}
+	}
+	if z, ok := table.Lookup("example.net"); ok {
+		t.Errorf("example.net: got zone %v, want none", z)
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const maxIncludeDepth = 8
+
+// zoneToken is one field of a master file entry. Quoted fields keep their
+// escapes, which are decoded by whoever interprets the field.
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// zoneEntry is one logical line of a master file: a directive or a record,
+// with parenthesised continuations joined and comments removed
+type zoneEntry struct {
+	line       int
+	blankOwner bool // started with whitespace, so the previous owner applies
+	tokens     []zoneToken
+}
+
+// zoneParser reads RFC 1035 master files (section 5) into records
+type zoneParser struct {
+	zone       string // apex; records outside it are rejected
+	origin     string // current $ORIGIN, appended to relative names
+	defaultTTL uint32 // $TTL (RFC 2308), or the last explicit TTL
+	haveTTL    bool
+	sawTTLDir  bool
+	owner      string // last owner name, for entries starting with blanks
+	haveOwner  bool
+	class      QClass // last explicit class
+	depth      int    // $INCLUDE nesting
+	records    []*DnsRecord
+}
+
+// ParseZoneFile reads the master file at path holding the zone origin,
+// following $INCLUDE directives relative to the file's directory
+func ParseZoneFile(path, origin string) ([]*DnsRecord, error) {
+	origin = strings.TrimSuffix(origin, ".")
+	p := &zoneParser{zone: origin, origin: origin, class: QClassIN}
+	if err := p.parseFile(path); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+func (p *zoneParser) parseFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	entries, err := splitZoneEntries(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, e := range entries {
+		if err := p.parseEntry(path, e); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, e.line, err)
+		}
+	}
+	return nil
+}
+
+// splitZoneEntries breaks master file text into entries. A semicolon starts
+// a comment running to the end of the line, parentheses let an entry span
+// several lines and double quotes group a field containing blanks.
+func splitZoneEntries(data string) ([]zoneEntry, error) {
+	var entries []zoneEntry
+	var cur zoneEntry
+	var tok strings.Builder
+	inTok, quoted, inQuote := false, false, false
+	parens, line, lineStart := 0, 1, true
+
+	flush := func() {
+		if inTok {
+			if len(cur.tokens) == 0 {
+				cur.line = line
+			}
+			cur.tokens = append(cur.tokens, zoneToken{text: tok.String(), quoted: quoted})
+		}
+		tok.Reset()
+		inTok, quoted = false, false
+	}
+	endEntry := func() {
+		if len(cur.tokens) > 0 {
+			entries = append(entries, cur)
+		}
+		cur = zoneEntry{}
+		lineStart = true
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if lineStart {
+			lineStart = false
+			if c == ' ' || c == '\t' {
+				cur.blankOwner = true
+			}
+		}
+		if inQuote {
+			switch c {
+			case '"':
+				inQuote = false
+				continue
+			case '\\':
+				if i+1 < len(data) {
+					tok.WriteByte(c)
+					i++
+					c = data[i]
+				}
+			}
+			if c == '\n' {
+				line++
+			}
+			tok.WriteByte(c)
+			continue
+		}
+		switch c {
+		case ';':
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case '"':
+			flush()
+			inTok, quoted, inQuote = true, true, true
+		case '(':
+			flush()
+			parens++
+		case ')':
+			flush()
+			if parens == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced ')'", line)
+			}
+			parens--
+		case ' ', '\t', '\r':
+			flush()
+		case '\n':
+			flush()
+			line++
+			if parens == 0 {
+				endEntry()
+			}
+		case '\\':
+			tok.WriteByte(c)
+			if i+1 < len(data) {
+				i++
+				tok.WriteByte(data[i])
+			}
+			inTok = true
+		default:
+			tok.WriteByte(c)
+			inTok = true
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if parens > 0 {
+		return nil, errors.New("unbalanced '('")
+	}
+	flush()
+	endEntry()
+	return entries, nil
+}
+
+func (p *zoneParser) parseEntry(path string, e zoneEntry) error {
+	tokens := e.tokens
+	if !e.blankOwner && strings.HasPrefix(tokens[0].text, "$") && !tokens[0].quoted {
+		return p.directive(path, tokens)
+	}
+
+	if e.blankOwner {
+		if !p.haveOwner {
+			return errors.New("record without owner name")
+		}
+	} else {
+		owner, err := p.name(tokens[0])
+		if err != nil {
+			return err
+		}
+		p.owner, p.haveOwner = owner, true
+		tokens = tokens[1:]
+	}
+
+	// [TTL] [class] type, with TTL and class in either order
+	var ttl uint32
+	haveTTL := false
+	class := p.class
+	for len(tokens) > 0 && !tokens[0].quoted {
+		t := tokens[0].text
+		if t[0] >= '0' && t[0] <= '9' && !haveTTL {
+			v, err := parseTTL(t)
+			if err != nil {
+				return err
+			}
+			ttl, haveTTL = v, true
+		} else if qc, ok := zoneClass(t); ok {
+			class = qc
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return errors.New("missing record type")
+	}
+	qtype, err := ParseQType(tokens[0].text)
+	if err != nil {
+		return err
+	}
+	rdata, err := p.rdata(qtype, tokens[1:])
+	if err != nil {
+		return fmt.Errorf("%s record: %w", qtype, err)
+	}
+
+	soa, isSOA := rdata.(*RDataSOA)
+	switch {
+	case haveTTL:
+		// without $TTL an explicit TTL becomes the default (RFC 1035 5.1)
+		if !p.sawTTLDir {
+			p.defaultTTL, p.haveTTL = ttl, true
+		}
+	case p.haveTTL:
+		ttl = p.defaultTTL
+	case isSOA:
+		// no $TTL and no TTL yet: fall back on the SOA minimum like BIND
+		ttl = soa.Minimum
+		p.defaultTTL, p.haveTTL = ttl, true
+	default:
+		return errors.New("no TTL given and no $TTL in effect")
+	}
+	p.class = class
+
+	if !inBailiwick(p.owner, p.zone) {
+		return fmt.Errorf("%s is outside zone %s", fqdn(p.owner), fqdn(p.zone))
+	}
+	p.records = append(p.records, &DnsRecord{Name: p.owner, Type: qtype, Class: class, TTL: ttl, RData: rdata})
+	return nil
+}
+
+// directive handles $ORIGIN, $TTL and $INCLUDE
+func (p *zoneParser) directive(path string, tokens []zoneToken) error {
+	switch strings.ToUpper(tokens[0].text) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return errors.New("$ORIGIN takes one name")
+		}
+		origin, err := p.name(tokens[1])
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+	case "$TTL":
+		if len(tokens) != 2 {
+			return errors.New("$TTL takes one value")
+		}
+		ttl, err := parseTTL(tokens[1].text)
+		if err != nil {
+			return err
+		}
+		p.defaultTTL, p.haveTTL, p.sawTTLDir = ttl, true, true
+	case "$INCLUDE":
+		if len(tokens) < 2 || len(tokens) > 3 {
+			return errors.New("$INCLUDE takes a file name and an optional origin")
+		}
+		if p.depth >= maxIncludeDepth {
+			return errors.New("$INCLUDE nested too deeply")
+		}
+		file := tokens[1].text
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		// the included file may change origin and owner, but they revert
+		// afterwards (RFC 1035 5.1)
+		origin, owner, haveOwner := p.origin, p.owner, p.haveOwner
+		if len(tokens) == 3 {
+			o, err := p.name(tokens[2])
+			if err != nil {
+				return err
+			}
+			p.origin = o
+		}
+		p.depth++
+		err := p.parseFile(file)
+		p.depth--
+		p.origin, p.owner, p.haveOwner = origin, owner, haveOwner
+		return err
+	default:
+		return fmt.Errorf("unsupported directive %s", tokens[0].text)
+	}
+	return nil
+}
+
+// name turns a domain name field into an absolute name without trailing
+// dot: "@" is the origin and names not ending in a dot are relative to it
+func (p *zoneParser) name(tok zoneToken) (string, error) {
+	if tok.text == "@" && !tok.quoted {
+		return p.origin, nil
+	}
+	if tok.text == "." {
+		return "", nil
+	}
+
+	var labels []string
+	var label strings.Builder
+	absolute := false
+	s := tok.text
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '.':
+			if label.Len() == 0 {
+				return "", fmt.Errorf("empty label in %q", s)
+			}
+			labels = append(labels, label.String())
+			label.Reset()
+			absolute = i == len(s)-1
+		case '\\':
+			b, n, err := unescapeAt(s, i)
+			if err != nil {
+				return "", err
+			}
+			if b == '.' {
+				return "", fmt.Errorf("escaped dot in %q is not supported", s)
+			}
+			label.WriteByte(b)
+			i += n - 1
+		default:
+			label.WriteByte(c)
+		}
+	}
+	if label.Len() > 0 {
+		labels = append(labels, label.String())
+	}
+	for _, l := range labels {
+		if len(l) > 63 {
+			return "", fmt.Errorf("label too long in %q", s)
+		}
+	}
+
+	name := strings.Join(labels, ".")
+	if !absolute && p.origin != "" {
+		name += "." + p.origin
+	}
+	if len(name) > 253 {
+		return "", fmt.Errorf("name too long: %q", s)
+	}
+	return name, nil
+}
+
+// rdata parses the RDATA fields of a record of type qtype. Any type may be
+// given in the generic form "\# length hex" (RFC 3597 5).
+func (p *zoneParser) rdata(qtype QType, fields []zoneToken) (RData, error) {
+	if len(fields) > 0 && fields[0].text == `\#` && !fields[0].quoted {
+		return genericRData(qtype, fields[1:])
+	}
+	want := func(n int) error {
+		if len(fields) != n {
+			return fmt.Errorf("want %d fields, got %d", n, len(fields))
+		}
+		return nil
+	}
+
+	switch qtype {
+	case QTypeA:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0].text).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("bad IPv4 address %q", fields[0].text)
+		}
+		return &RDataA{IP: ip}, nil
+	case QTypeAAAA:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0].text)
+		if ip == nil || !strings.Contains(fields[0].text, ":") {
+			return nil, fmt.Errorf("bad IPv6 address %q", fields[0].text)
+		}
+		return &RDataAAAA{IP: ip}, nil
+	case QTypeNS, QTypeCNAME, QTypePTR:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		host, err := p.name(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		switch qtype {
+		case QTypeNS:
+			return &RDataNS{Host: host}, nil
+		case QTypeCNAME:
+			return &RDataCNAME{Target: host}, nil
+		}
+		return &RDataPTR{Host: host}, nil
+	case QTypeMX:
+		if err := want(2); err != nil {
+			return nil, err
+		}
+		pref, err := strconv.ParseUint(fields[0].text, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad preference %q", fields[0].text)
+		}
+		exchange, err := p.name(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return &RDataMX{Preference: uint16(pref), Exchange: exchange}, nil
+	case QTypeSOA:
+		if err := want(7); err != nil {
+			return nil, err
+		}
+		soa := &RDataSOA{}
+		var err error
+		if soa.MName, err = p.name(fields[0]); err != nil {
+			return nil, err
+		}
+		if soa.RName, err = p.name(fields[1]); err != nil {
+			return nil, err
+		}
+		serial, err := strconv.ParseUint(fields[2].text, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad serial %q", fields[2].text)
+		}
+		soa.Serial = uint32(serial)
+		for i, f := range []*uint32{&soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum} {
+			if *f, err = parseTTL(fields[3+i].text); err != nil {
+				return nil, err
+			}
+		}
+		return soa, nil
+	case QTypeTXT:
+		if len(fields) == 0 {
+			return nil, errors.New("no character-strings")
+		}
+		txt := &RDataTXT{}
+		for _, f := range fields {
+			s, err := unescape(f.text)
+			if err != nil {
+				return nil, err
+			}
+			if len(s) > 255 {
+				return nil, errors.New("character-string longer than 255 bytes")
+			}
+			txt.Strings = append(txt.Strings, s)
+		}
+		return txt, nil
+	case QTypeSRV:
+		if err := want(4); err != nil {
+			return nil, err
+		}
+		srv := &RDataSRV{}
+		for i, f := range []*uint16{&srv.Priority, &srv.Weight, &srv.Port} {
+			v, err := strconv.ParseUint(fields[i].text, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("bad number %q", fields[i].text)
+			}
+			*f = uint16(v)
+		}
+		target, err := p.name(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		srv.Target = target
+		return srv, nil
+	case QTypeCAA:
+		if err := want(3); err != nil {
+			return nil, err
+		}
+		flags, err := strconv.ParseUint(fields[0].text, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad flags %q", fields[0].text)
+		}
+		value, err := unescape(fields[2].text)
+		if err != nil {
+			return nil, err
+		}
+		return &RDataCAA{Flags: uint8(flags), Tag: fields[1].text, Value: value}, nil
+	}
+	return nil, fmt.Errorf(`no presentation format for %s, use \# syntax`, qtype)
+}
+
+// genericRData decodes "length hex..." and interprets the bytes as qtype,
+// so a known type given in generic form is stored as if parsed normally
+func genericRData(qtype QType, fields []zoneToken) (RData, error) {
+	if len(fields) == 0 {
+		return nil, errors.New(`\# needs a length`)
+	}
+	n, err := strconv.ParseUint(fields[0].text, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad length %q", fields[0].text)
+	}
+	var hexData strings.Builder
+	for _, f := range fields[1:] {
+		hexData.WriteString(f.text)
+	}
+	data, err := hex.DecodeString(hexData.String())
+	if err != nil {
+		return nil, fmt.Errorf("bad hex data: %w", err)
+	}
+	if len(data) != int(n) {
+		return nil, fmt.Errorf("length %d does not match %d bytes of data", n, len(data))
+	}
+	buf := NewPacketBufferWithSize(len(data))
+	copy(buf.buf, data)
+	return readRData(buf, qtype, len(data))
+}
+
+// zoneClass recognises the class field of a record
+func zoneClass(s string) (QClass, bool) {
+	if s == "*" || strings.EqualFold(s, "ANY") || strings.EqualFold(s, "NONE") {
+		return 0, false
+	}
+	qc, err := ParseQClass(s)
+	return qc, err == nil
+}
+
+// parseTTL parses a TTL in seconds, also accepting BIND style units such
+// as 1h30m or 2w
+func parseTTL(s string) (uint32, error) {
+	var total, n uint64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		unit := uint64(0)
+		switch c {
+		case 's':
+			unit = 1
+		case 'm':
+			unit = 60
+		case 'h':
+			unit = 3600
+		case 'd':
+			unit = 86400
+		case 'w':
+			unit = 604800
+		default:
+			if c < '0' || c > '9' {
+				return 0, fmt.Errorf("bad TTL %q", s)
+			}
+			n = n*10 + uint64(c-'0')
+			digits = true
+			if n > math.MaxUint32 {
+				return 0, fmt.Errorf("TTL %q out of range", s)
+			}
+			continue
+		}
+		if !digits {
+			return 0, fmt.Errorf("bad TTL %q", s)
+		}
+		total += n * unit
+		n, digits = 0, false
+	}
+	if s == "" {
+		return 0, errors.New("empty TTL")
+	}
+	total += n
+	if total > math.MaxUint32 {
+		return 0, fmt.Errorf("TTL %q out of range", s)
+	}
+	return uint32(total), nil
+}
+
+// unescape decodes \X and \DDD escapes in a field
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		b, n, err := unescapeAt(s, i)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(b)
+		i += n - 1
+	}
+	return sb.String(), nil
+}
+
+// unescapeAt decodes the escape starting with the backslash at s[i] and
+// returns the byte and the escape's length
+func unescapeAt(s string, i int) (byte, int, error) {
+	if i+1 >= len(s) {
+		return 0, 0, fmt.Errorf("dangling backslash in %q", s)
+	}
+	if s[i+1] < '0' || s[i+1] > '9' {
+		return s[i+1], 2, nil
+	}
+	if i+4 > len(s) {
+		return 0, 0, fmt.Errorf("bad escape in %q", s)
+	}
+	v, err := strconv.ParseUint(s[i+1:i+4], 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad escape in %q", s)
+	}
+	return byte(v), 4, nil
+}